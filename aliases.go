@@ -0,0 +1,15 @@
+package main
+
+// resolveModel returns the canonical model an alias maps to. Models that
+// aren't aliases are returned unchanged.
+func resolveModel(aliases map[string]string, model string) string {
+	if len(aliases) == 0 || model == "" {
+		return model
+	}
+	if canonical, ok := aliases[model]; ok {
+		parserLog.Debugf("Resolved model alias %q to %q", model, canonical)
+		return canonical
+	}
+	parserLog.Debugf("Model %q is not an alias, using it as is", model)
+	return model
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// W3C Baggage limits on the whole header.
+const (
+	maxBaggageMembers = 64
+	maxBaggageBytes   = 8192
+)
+
+// usageBaggage returns the llm.* baggage entries for usage, in order.
+func usageBaggage(model string, usage *tokenUsage) [][2]string {
+	entries := [][2]string{
+		{"llm.prompt_tokens", strconv.FormatInt(usage.PromptTokens, 10)},
+		{"llm.completion_tokens", strconv.FormatInt(usage.CompletionTokens, 10)},
+		{"llm.total_tokens", strconv.FormatInt(usage.TotalTokens, 10)},
+	}
+	if model != "" {
+		entries = append(entries, [2]string{"llm.model", model})
+	}
+	return entries
+}
+
+// mergeBaggage adds entries to an existing baggage header, replacing members
+// with the same key and keeping everything else. Entries that would take the
+// header past the W3C limits are left out.
+func mergeBaggage(existing string, entries [][2]string) string {
+	replaced := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		replaced[e[0]] = true
+	}
+	var members []string
+	size := 0
+	for _, m := range strings.Split(existing, ",") {
+		m = strings.TrimSpace(m)
+		key, _, _ := strings.Cut(m, "=")
+		if m == "" || replaced[strings.TrimSpace(key)] {
+			continue
+		}
+		members = append(members, m)
+		size += len(m) + 1
+	}
+	for _, e := range entries {
+		m := e[0] + "=" + encodeBaggageValue(e[1])
+		if len(members) >= maxBaggageMembers || size+len(m) > maxBaggageBytes {
+			baggageLog.Warnf("Dropping %s, baggage would exceed W3C limits", e[0])
+			continue
+		}
+		members = append(members, m)
+		size += len(m) + 1
+	}
+	return strings.Join(members, ",")
+}
+
+// encodeBaggageValue percent-encodes every byte that isn't a baggage-octet,
+// plus '%' itself.
+func encodeBaggageValue(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c > 0x20 && c < 0x7f && c != '"' && c != ',' && c != ';' && c != '\\' && c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// counterBatch accumulates increments to a CounterVec in sharded local maps
+// and adds them to the vec every flush interval, so concurrent requests
+// contend on one of several shard locks rather than the vec's label lookup
+// and the counters' atomics. Scrapes lag by up to the interval.
+type counterBatch struct {
+	vec    *prometheus.CounterVec
+	shards []counterShard
+
+	// closed is set before the final flush; adds that see it go straight to
+	// the vec
+	closed atomic.Bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type counterShard struct {
+	mu     sync.Mutex
+	counts map[string]*batchedCount
+}
+
+type batchedCount struct {
+	labels []string
+	n      float64
+}
+
+// batchShards is how many shards adds are spread over at random; more than
+// this gains little on typical core counts.
+const batchShards = 16
+
+func newCounterBatch(vec *prometheus.CounterVec, interval time.Duration) *counterBatch {
+	b := &counterBatch{
+		vec:    vec,
+		shards: make([]counterShard, batchShards),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	for i := range b.shards {
+		b.shards[i].counts = make(map[string]*batchedCount)
+	}
+	go func() {
+		defer close(b.done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				b.flush()
+			case <-b.stop:
+				b.flush()
+				return
+			}
+		}
+	}()
+	return b
+}
+
+// add batches v for the counter with the given label values. labels is
+// copied, so callers may reuse it.
+func (b *counterBatch) add(labels []string, v float64) {
+	// the key is built on the stack and only copied into a string when a
+	// new label set is first inserted
+	var buf [256]byte
+	key := buf[:0]
+	for _, l := range labels {
+		key = append(append(key, l...), 0xff)
+	}
+	// rand's source is per-thread, so picking a shard shares no state
+	sh := &b.shards[rand.N(batchShards)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	// checked under the shard lock: an add that sees closed unset holds the
+	// lock the final flush needs, so the flush still picks it up
+	if b.closed.Load() {
+		b.vec.WithLabelValues(labels...).Add(v)
+		return
+	}
+	c, ok := sh.counts[string(key)]
+	if !ok {
+		c = &batchedCount{labels: append([]string(nil), labels...)}
+		sh.counts[string(key)] = c
+	}
+	c.n += v
+}
+
+// flush adds every batched count to the vec. Each shard is swapped out under
+// its lock, so adds racing a flush land in either this flush or the next,
+// never in neither.
+func (b *counterBatch) flush() {
+	for i := range b.shards {
+		sh := &b.shards[i]
+		sh.mu.Lock()
+		counts := sh.counts
+		sh.counts = make(map[string]*batchedCount, len(counts))
+		sh.mu.Unlock()
+		for _, c := range counts {
+			b.vec.WithLabelValues(c.labels...).Add(c.n)
+		}
+	}
+}
+
+// close stops the periodic flush after a final one. Adds after close are
+// made directly to the vec. Closing more than once is a no-op.
+func (b *counterBatch) close() {
+	if b.closed.Swap(true) {
+		return
+	}
+	close(b.stop)
+	<-b.done
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestCounterVec() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total"}, []string{"type", "model"})
+}
+
+func TestCounterBatchConcurrentFlush(t *testing.T) {
+	vec := newTestCounterVec()
+	b := newCounterBatch(vec, time.Millisecond)
+	const workers, adds = 8, 2000
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			labels := []string{"prompt", "gpt-4o"}
+			if w%2 == 1 {
+				labels[0] = "completion"
+			}
+			for range adds {
+				b.add(labels, 1)
+			}
+		}()
+	}
+	// flush from here too while the ticker flushes and adds race both
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 50 {
+			b.flush()
+		}
+	}()
+	wg.Wait()
+	<-done
+	b.close()
+	for _, typ := range []string{"prompt", "completion"} {
+		if got, want := testutil.ToFloat64(vec.WithLabelValues(typ, "gpt-4o")), float64(workers/2*adds); got != want {
+			t.Errorf("%s = %v, want %v", typ, got, want)
+		}
+	}
+}
+
+func TestCounterBatchAddAfterClose(t *testing.T) {
+	vec := newTestCounterVec()
+	b := newCounterBatch(vec, time.Hour)
+	b.add([]string{"prompt", "gpt-4o"}, 2)
+	b.close()
+	b.add([]string{"prompt", "gpt-4o"}, 3)
+	b.close()
+	if got := testutil.ToFloat64(vec.WithLabelValues("prompt", "gpt-4o")); got != 5 {
+		t.Errorf("got %v, want 5", got)
+	}
+}
+
+func BenchmarkCounterAdd(b *testing.B) {
+	labels := []string{"prompt", "gpt-4o"}
+	b.Run("vec", func(b *testing.B) {
+		vec := newTestCounterVec()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				vec.WithLabelValues(labels...).Add(1)
+			}
+		})
+	})
+	b.Run("batch", func(b *testing.B) {
+		batch := newCounterBatch(newTestCounterVec(), time.Second)
+		defer batch.close()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				batch.add(labels, 1)
+			}
+		})
+	})
+}
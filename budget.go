@@ -0,0 +1,44 @@
+package main
+
+import (
+	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+// frameName names a request's frame type for logs and metric labels.
+func frameName(req *extProcPb.ProcessingRequest) string {
+	switch req.Request.(type) {
+	case *extProcPb.ProcessingRequest_RequestHeaders:
+		return "request_headers"
+	case *extProcPb.ProcessingRequest_RequestBody:
+		return "request_body"
+	case *extProcPb.ProcessingRequest_RequestTrailers:
+		return "request_trailers"
+	case *extProcPb.ProcessingRequest_ResponseHeaders:
+		return "response_headers"
+	case *extProcPb.ProcessingRequest_ResponseBody:
+		return "response_body"
+	case *extProcPb.ProcessingRequest_ResponseTrailers:
+		return "response_trailers"
+	}
+	return "unknown"
+}
+
+// continueResponse answers req by letting the frame continue unmodified,
+// without processing it.
+func continueResponse(req *extProcPb.ProcessingRequest) *extProcPb.ProcessingResponse {
+	switch req.Request.(type) {
+	case *extProcPb.ProcessingRequest_RequestHeaders:
+		return &extProcPb.ProcessingResponse{Response: &extProcPb.ProcessingResponse_RequestHeaders{RequestHeaders: &extProcPb.HeadersResponse{}}}
+	case *extProcPb.ProcessingRequest_RequestBody:
+		return &extProcPb.ProcessingResponse{Response: &extProcPb.ProcessingResponse_RequestBody{RequestBody: &extProcPb.BodyResponse{}}}
+	case *extProcPb.ProcessingRequest_RequestTrailers:
+		return &extProcPb.ProcessingResponse{Response: &extProcPb.ProcessingResponse_RequestTrailers{RequestTrailers: &extProcPb.TrailersResponse{}}}
+	case *extProcPb.ProcessingRequest_ResponseHeaders:
+		return &extProcPb.ProcessingResponse{Response: &extProcPb.ProcessingResponse_ResponseHeaders{ResponseHeaders: &extProcPb.HeadersResponse{}}}
+	case *extProcPb.ProcessingRequest_ResponseBody:
+		return &extProcPb.ProcessingResponse{Response: &extProcPb.ProcessingResponse_ResponseBody{ResponseBody: &extProcPb.BodyResponse{}}}
+	case *extProcPb.ProcessingRequest_ResponseTrailers:
+		return &extProcPb.ProcessingResponse{Response: &extProcPb.ProcessingResponse_ResponseTrailers{ResponseTrailers: &extProcPb.TrailersResponse{}}}
+	}
+	return &extProcPb.ProcessingResponse{}
+}
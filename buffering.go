@@ -0,0 +1,47 @@
+package main
+
+import (
+	"mime"
+	"strconv"
+
+	filterPb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+)
+
+// adaptiveBufferingConfig chooses the response body mode per response:
+// buffering is cheap for small responses but costly for large streaming ones.
+type adaptiveBufferingConfig struct {
+	// MaxBufferedBytes is the largest content-length that is BUFFERED;
+	// larger responses are STREAMED. A BUFFERED body that grows past it is
+	// passed through without its usage parsed.
+	MaxBufferedBytes int64 `json:"max_buffered_bytes"`
+	// Models overrides MaxBufferedBytes for responses to requests for these
+	// models, e.g. larger for long-context models.
+	Models map[string]int64 `json:"models,omitempty"`
+}
+
+// maxBufferedBytes returns the largest content-length buffered for model.
+func (c *adaptiveBufferingConfig) maxBufferedBytes(model string) int64 {
+	if n, ok := c.Models[model]; ok {
+		return n
+	}
+	return c.MaxBufferedBytes
+}
+
+// bodyMode returns the response body mode for a response to a request for
+// model. Without a content-length, event streams are STREAMED and anything
+// else BUFFERED. A nil config always buffers.
+func (c *adaptiveBufferingConfig) bodyMode(model, contentType, contentLength string) filterPb.ProcessingMode_BodySendMode {
+	if c == nil {
+		return filterPb.ProcessingMode_BUFFERED
+	}
+	if n, err := strconv.ParseInt(contentLength, 10, 64); err == nil {
+		if n <= c.maxBufferedBytes(model) {
+			return filterPb.ProcessingMode_BUFFERED
+		}
+		return filterPb.ProcessingMode_STREAMED
+	}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "text/event-stream" {
+		return filterPb.ProcessingMode_STREAMED
+	}
+	return filterPb.ProcessingMode_BUFFERED
+}
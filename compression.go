@@ -0,0 +1,84 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc/encoding"
+)
+
+// gzipCompressor lets Envoy negotiate gzip-compressed gRPC messages. It is
+// registered only when -grpc-gzip is set, so compression stays opt-in.
+// Writers and readers are pooled across messages rather than allocated per
+// message; grpc's own encoding/gzip would do the same but registers itself
+// on import, which would make compression always on.
+type gzipCompressor struct {
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (c *gzipCompressor) Name() string { return "gzip" }
+
+func (c *gzipCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	zw, ok := c.writers.Get().(*gzip.Writer)
+	if !ok {
+		zw = gzip.NewWriter(w)
+	} else {
+		zw.Reset(w)
+	}
+	return &pooledGzipWriter{Writer: zw, pool: &c.writers}, nil
+}
+
+func (c *gzipCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	zr, ok := c.readers.Get().(*gzip.Reader)
+	if !ok {
+		var err error
+		if zr, err = gzip.NewReader(r); err != nil {
+			return nil, err
+		}
+	} else if err := zr.Reset(r); err != nil {
+		c.readers.Put(zr)
+		return nil, err
+	}
+	return &pooledGzipReader{Reader: zr, pool: &c.readers}, nil
+}
+
+// pooledGzipWriter returns its writer to the pool once the message is
+// written.
+type pooledGzipWriter struct {
+	*gzip.Writer
+	pool *sync.Pool
+}
+
+func (w *pooledGzipWriter) Close() error {
+	err := w.Writer.Close()
+	w.pool.Put(w.Writer)
+	return err
+}
+
+// pooledGzipReader returns its reader to the pool once the message has been
+// read to the end.
+type pooledGzipReader struct {
+	*gzip.Reader
+	pool *sync.Pool
+}
+
+func (r *pooledGzipReader) Read(p []byte) (int, error) {
+	if r.Reader == nil {
+		return 0, io.EOF
+	}
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		r.pool.Put(r.Reader)
+		r.Reader = nil
+	}
+	return n, err
+}
+
+// enableGzip registers the gzip compressor. The server then accepts gzip
+// requests and compresses its responses to clients that use it. Like any
+// compressor registration it must happen before the server starts.
+func enableGzip() {
+	encoding.RegisterCompressor(&gzipCompressor{})
+}
@@ -0,0 +1,943 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	configPb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/prometheus/common/model"
+	"sigs.k8s.io/yaml"
+)
+
+// defaultMaxTokenCount bounds plausible token counts, well above any real
+// context window but far from overflow.
+const defaultMaxTokenCount = 1_000_000_000
+
+// defaultContextWarnThreshold is the context utilization above which requests
+// are logged as close to the model's limit.
+const defaultContextWarnThreshold = 0.9
+
+// config is the optional file-based configuration, loaded from -config. Both
+// YAML and JSON are accepted.
+type config struct {
+	// RateLimit caps the global request rate. Off when unset.
+	RateLimit *rateLimitConfig `json:"rate_limit,omitempty"`
+
+	// ModelConcurrency caps the number of in-flight requests per model.
+	// Models without an entry are unlimited.
+	ModelConcurrency map[string]int `json:"model_concurrency,omitempty"`
+
+	// Parsers restricts usage parsing to these registered parsers. A
+	// response whose content type selects any other parser, including the
+	// json fallback for unrecognised types, fails to parse, as does a 2xx
+	// completions or embeddings response that carries no usage at all.
+	Parsers []string `json:"parsers,omitempty"`
+	// ParseFailureMode is what happens to a 2xx response that fails to parse
+	// under Parsers: pass (the default) lets it through, reject replaces it
+	// with a 502.
+	ParseFailureMode string `json:"parse_failure_mode,omitempty"`
+
+	// ZeroUsage is how responses whose usage is all zero, often an error or
+	// a cached empty response, are decorated: "emit" the zero headers (the
+	// default), "skip" the usage headers or "mark" them with
+	// x-llm-zero-usage: true.
+	ZeroUsage string `json:"zero_usage,omitempty"`
+
+	// ParserSelfTest runs every parser against an embedded fixture at
+	// startup. "fail" refuses to start if any parser's output is wrong and
+	// "warn" logs a warning per parser instead. Off when unset.
+	ParserSelfTest string `json:"parser_self_test,omitempty"`
+
+	// ShadowParser names a candidate parser from the registry to run alongside
+	// the default one. Its result is only compared, never emitted.
+	ShadowParser string `json:"shadow_parser,omitempty"`
+
+	// ResponseTimeout bounds how long a response may take to complete,
+	// measured from its first body frame. Zero disables it.
+	ResponseTimeout duration `json:"response_timeout,omitempty"`
+
+	// ResponseIdleTimeout treats a response whose body frames stop arriving
+	// for this long without EndOfStream as ended, recording the usage the
+	// upstream reported in what has arrived. Must be shorter than
+	// ResponseTimeout when both are set. Zero disables it.
+	ResponseIdleTimeout duration `json:"response_idle_timeout,omitempty"`
+
+	// ProcessingBudget is the most time the filter should spend handling a
+	// single frame. Frames over it are logged and counted, and with
+	// ProcessingBudgetFastReturn the rest of that stream is passed through
+	// unprocessed. Zero disables it.
+	ProcessingBudget           duration `json:"processing_budget,omitempty"`
+	ProcessingBudgetFastReturn bool     `json:"processing_budget_fast_return,omitempty"`
+
+	// StrictTotalTokens emits total_tokens exactly as reported. By default a
+	// missing or zero total is computed as prompt + completion.
+	StrictTotalTokens bool `json:"strict_total_tokens,omitempty"`
+
+	// MaxTokenCount is the largest token count accepted from an upstream;
+	// negative counts are always invalid. Defaults to 1e9.
+	MaxTokenCount int64 `json:"max_token_count,omitempty"`
+
+	// ClampTokenCounts clamps out-of-range counts into [0, max_token_count]
+	// rather than discarding the response's usage.
+	ClampTokenCounts bool `json:"clamp_token_counts,omitempty"`
+
+	// RequestIDHeader is the request header carrying the request id used for
+	// logging, usage events and sampling. Defaults to x-request-id.
+	RequestIDHeader string `json:"request_id_header,omitempty"`
+
+	// PreferOriginalPath takes the request path from x-envoy-original-path,
+	// when Envoy sets it after rewriting the path, rather than :path, for
+	// all path-based logic: endpoint detection, passthrough, sampling and
+	// request schemas.
+	PreferOriginalPath bool `json:"prefer_original_path,omitempty"`
+
+	// ContextWindows are models' context window sizes in tokens. Requests to
+	// these models report prompt_tokens / context window as context
+	// utilization.
+	ContextWindows map[string]int64 `json:"context_windows,omitempty"`
+	// ContextWarnThreshold is the utilization above which a warning is
+	// logged. Defaults to 0.9.
+	ContextWarnThreshold float64 `json:"context_warn_threshold,omitempty"`
+
+	// TenantHeader names the request header identifying the tenant.
+	TenantHeader string `json:"tenant_header,omitempty"`
+
+	// Pricing maps models to USD per million tokens, used to cost usage.
+	Pricing pricingTable `json:"pricing,omitempty"`
+
+	// TenantPricing overrides Pricing per tenant, keyed by the value of
+	// TenantHeader, for tenants with negotiated rates.
+	TenantPricing map[string]pricingTable `json:"tenant_pricing,omitempty"`
+
+	// TenantModels restricts tenants, keyed by the value of TenantHeader, to
+	// the listed models; their requests for any other model are rejected
+	// with a 403. Models are matched after ModelAliases. Tenants without an
+	// entry may use any model. Requires BufferRequestBody, since the model
+	// can only be read from a request body Envoy sends in one frame.
+	TenantModels map[string][]string `json:"tenant_models,omitempty"`
+
+	// RetryCostWindow, when set, accumulates the cost of every attempt at a
+	// request, keyed by its request id, for this long after its latest
+	// attempt, and reports the total on the final attempt in
+	// x-llm-request-total-cost and usage events.
+	RetryCostWindow duration `json:"retry_cost_window,omitempty"`
+
+	// Credits maps models to their rate in billing credits, reported in
+	// x-llm-credits, credits_total and usage events. Models without a rate
+	// report no credits.
+	Credits map[string]creditRate `json:"credits,omitempty"`
+
+	// DynamicMetadataNamespace, when set, writes token counts and cost to
+	// Envoy dynamic metadata under this namespace for access logging.
+	DynamicMetadataNamespace string `json:"dynamic_metadata_namespace,omitempty"`
+
+	// AccountingMetadataFlag names a boolean, as namespace.key, in the
+	// metadata Envoy forwards with each request. Requests where it is false
+	// are passed through unprocessed; where it is absent they are processed.
+	AccountingMetadataFlag string `json:"accounting_metadata_flag,omitempty"`
+
+	// ModelPrefix reports models prefixed with their provider, e.g.
+	// openai/gpt-4o, in metrics, headers and usage events.
+	ModelPrefix *modelPrefixConfig `json:"model_prefix,omitempty"`
+
+	// ModelAliases maps the model names clients send, e.g. "fast", to the
+	// canonical model they are priced, labeled and reported as. Models not
+	// listed are used as sent.
+	ModelAliases map[string]string `json:"model_aliases,omitempty"`
+
+	// MaxModelLabels caps the distinct model names recorded as metric labels;
+	// further models are recorded as "other". Model names come from request
+	// bodies, so without a cap a client could create unbounded series.
+	MaxModelLabels int `json:"max_model_labels,omitempty"`
+
+	// MetricsFlushInterval batches tokens_total increments locally and adds
+	// them to the registry at this interval, trading scrape freshness for
+	// less contention under heavy load. Zero updates counters directly.
+	MetricsFlushInterval duration `json:"metrics_flush_interval,omitempty"`
+
+	// MetricLabelHeaders lifts request headers into token metric labels.
+	MetricLabelHeaders []headerLabel `json:"metric_label_headers,omitempty"`
+
+	// TraceIDHeaders emits x-trace-id and x-span-id response headers
+	// identifying the filter's span for each request.
+	TraceIDHeaders bool `json:"trace_id_headers,omitempty"`
+
+	// TraceExemplars attaches the trace and span ids of a request's
+	// traceparent, when it has one, as exemplars on its request_tokens
+	// observations. Exemplars are only scraped in the OpenMetrics format.
+	TraceExemplars bool `json:"trace_exemplars,omitempty"`
+
+	// MaxHeaderValueLength caps the length of every header value the filter
+	// sets, truncating longer ones with a "..." marker, for downstream
+	// proxies that reject long values. Unlimited when unset.
+	MaxHeaderValueLength int `json:"max_header_value_length,omitempty"`
+
+	// ProcessingID generates an id for every processed request, uuid or
+	// ulid, set as x-token-ext-proc-id on the response and carried in logs,
+	// usage events and metric exemplars. Off when unset.
+	ProcessingID string `json:"processing_id,omitempty"`
+
+	// HeaderAppendAction is the Envoy HeaderAppendAction of every header the
+	// filter sets: APPEND_IF_EXISTS_OR_ADD (Envoy's default), ADD_IF_ABSENT,
+	// OVERWRITE_IF_EXISTS_OR_ADD or OVERWRITE_IF_EXISTS.
+	HeaderAppendAction string `json:"header_append_action,omitempty"`
+
+	// StaticResponseHeaders are set on every response whose body the filter
+	// processes, whether or not usage was parsed.
+	StaticResponseHeaders map[string]string `json:"static_response_headers,omitempty"`
+
+	// RequestReceivedAt stamps x-llm-request-received-at, the time the filter
+	// saw the request headers, on the upstream request and the response.
+	// Either "rfc3339" or "epoch_ms"; off when unset.
+	RequestReceivedAt string `json:"request_received_at,omitempty"`
+
+	// RequestSchemas validate request bodies against JSON schemas by path
+	// prefix. Requests that fail get a 400. Requires the request body.
+	RequestSchemas []requestSchema `json:"request_schemas,omitempty"`
+
+	// BufferRequestBody asks Envoy, via ModeOverride, to send the buffered
+	// request body so the model, max_tokens and message count can be read
+	// even when the filter config doesn't buffer request bodies.
+	BufferRequestBody bool `json:"buffer_request_body,omitempty"`
+
+	// RequestDecompressionLimitBytes decompresses gzip-encoded request bodies
+	// before they are parsed, up to this many decompressed bytes. Bodies that
+	// are larger or fail to decompress are treated as plain. Off when unset.
+	RequestDecompressionLimitBytes int64 `json:"request_decompression_limit_bytes,omitempty"`
+
+	// AdaptiveBuffering picks BUFFERED or STREAMED response body mode per
+	// response. Without it responses are always BUFFERED.
+	AdaptiveBuffering *adaptiveBufferingConfig `json:"adaptive_buffering,omitempty"`
+
+	// BufferMemoryLimitBytes caps the request and response body bytes
+	// buffered across all streams. Once reached, new responses are passed through without usage
+	// parsing until buffered streams finish, and a response that would
+	// take it over the cap is dropped. Unlimited when unset.
+	BufferMemoryLimitBytes int64 `json:"buffer_memory_limit_bytes,omitempty"`
+
+	// InjectUsageIntoBody adds the normalized usage object to buffered JSON
+	// response bodies that lack one. Body rewriting is invasive, so this is
+	// off by default.
+	InjectUsageIntoBody bool `json:"inject_usage_into_body,omitempty"`
+
+	// Passthrough lists requests that skip body processing entirely.
+	Passthrough *passthroughConfig `json:"passthrough,omitempty"`
+
+	// LogLevels sets the minimum log level (debug, info, warn or error) per
+	// component, e.g. parser: debug. The "default" entry applies to
+	// components not listed; without one they log everything.
+	LogLevels map[string]string `json:"log_levels,omitempty"`
+
+	// RequestHash sets x-llm-request-hash, a SHA-256 of the request's
+	// canonicalized model and messages, on the upstream request and the
+	// response. Requires the request body.
+	RequestHash bool `json:"request_hash,omitempty"`
+
+	// EstimateMaxCost prices each request's worst case, its estimated prompt
+	// plus max_tokens, and sets it as x-llm-estimated-max-cost-usd on the
+	// upstream request and the response. Requires the request body.
+	EstimateMaxCost bool `json:"estimate_max_cost,omitempty"`
+
+	// ProviderHeader sets x-llm-provider on responses to the provider that
+	// served them: the one named in the request's own x-llm-provider
+	// header, the one model_prefix maps the host to, or one detected from
+	// the response (openai, anthropic or gemini).
+	ProviderHeader bool `json:"provider_header,omitempty"`
+
+	// ResponseFormatHeader sets x-llm-response-format on responses to the
+	// parser path usage was parsed on, e.g. json, json;fallback or
+	// sse;estimated, whether or not parsing succeeded.
+	ResponseFormatHeader bool `json:"response_format_header,omitempty"`
+
+	// StderrSummary writes a logfmt line per recorded request to stderr,
+	// with its model, provider, status, tokens, cost and duration, whatever
+	// the log levels. Only sampled requests are summarised.
+	StderrSummary bool `json:"stderr_summary,omitempty"`
+
+	// StreamUsageEstimate estimates the usage of streamed responses that
+	// report none, e.g. without stream_options.include_usage, from their
+	// generated text. Such responses are otherwise not accounted.
+	StreamUsageEstimate *streamEstimateConfig `json:"stream_usage_estimate,omitempty"`
+
+	// AvgTokensPerSecond keeps a moving average of each model's streaming
+	// throughput, emitted as x-llm-avg-tokens-per-second.
+	AvgTokensPerSecond *throughputConfig `json:"avg_tokens_per_second,omitempty"`
+
+	// Tokenizer is what token estimates are made with: request
+	// pre-estimates and stream_usage_estimate. A characters per token
+	// heuristic by default.
+	Tokenizer *tokenizerConfig `json:"tokenizer,omitempty"`
+
+	// ClassifyErrors reads the error type from OpenAI and Anthropic error
+	// bodies of non-2xx responses, counting provider_errors_total and
+	// setting x-llm-error-type instead of parsing usage.
+	ClassifyErrors bool `json:"classify_errors,omitempty"`
+
+	// LogRedactFields are the body fields masked wherever request or
+	// response bodies are logged, as dot-separated paths where * matches
+	// any key and [] every array element, e.g. messages[].content. With any
+	// set, bodies that aren't a complete JSON document are masked whole.
+	LogRedactFields []string `json:"log_redact_fields,omitempty"`
+
+	// ProcessingWarningHeader sets x-llm-processing-warning to a list of the
+	// optional steps that failed (usage, pricing, sink, inject), leaving it
+	// off when everything succeeded.
+	ProcessingWarningHeader bool `json:"processing_warning_header,omitempty"`
+
+	// EstimateDelta estimates each request's tokens from its prompt length
+	// and max_tokens, and reports how far the actual total was from it.
+	// Requires the request body.
+	EstimateDelta bool `json:"estimate_delta,omitempty"`
+
+	// DetectRefusals emits x-llm-refused and counts refusals_total when the
+	// model refuses or its output is content filtered.
+	DetectRefusals bool `json:"detect_refusals,omitempty"`
+
+	// UsageBaggage adds llm.* usage entries to the response's W3C baggage
+	// header, merged with any baggage the upstream sent.
+	UsageBaggage bool `json:"usage_baggage,omitempty"`
+
+	// Sampling parses usage for only a fraction of requests.
+	Sampling *samplingConfig `json:"sampling,omitempty"`
+
+	// SinkWorkers and SinkQueueSize size the worker pool that delivers usage
+	// events to sinks.
+	SinkWorkers   int `json:"sink_workers,omitempty"`
+	SinkQueueSize int `json:"sink_queue_size,omitempty"`
+
+	// Syslog enables the RFC 5424 syslog usage sink.
+	Syslog *syslogConfig `json:"syslog,omitempty"`
+
+	// SQLite enables the SQLite usage sink.
+	SQLite *sqliteConfig `json:"sqlite,omitempty"`
+
+	// Webhook enables the HTTP POST usage sink.
+	Webhook *webhookConfig `json:"webhook,omitempty"`
+
+	// DogStatsD enables the Datadog DogStatsD usage sink.
+	DogStatsD *dogStatsDConfig `json:"dogstatsd,omitempty"`
+
+	// GRPCSink forwards usage events to a downstream gRPC service.
+	GRPCSink *grpcSinkConfig `json:"grpc_sink,omitempty"`
+
+	// OTLP exports token and cost totals to an OTLP/gRPC collector.
+	OTLP *otlpConfig `json:"otlp,omitempty"`
+
+	// CloudWatchEMF enables the CloudWatch embedded metric format sink.
+	CloudWatchEMF *cloudWatchConfig `json:"cloudwatch_emf,omitempty"`
+}
+
+// streamEstimateConfig is set either to true, counting tokens with the
+// tokenizer, or, as before there was a tokenizer, to an object naming an
+// estimator of its own.
+type streamEstimateConfig struct {
+	Enabled bool `json:"-"`
+	// Estimator is chars, counting ratio characters as a token, or words,
+	// counting each word as ratio tokens. When unset the tokenizer is used.
+	Estimator string `json:"estimator,omitempty"`
+	// Ratio defaults to 4 characters per token for chars and 1.33 tokens
+	// per word for words.
+	Ratio float64 `json:"ratio,omitempty"`
+}
+
+func (c *streamEstimateConfig) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &c.Enabled); err == nil {
+		return nil
+	}
+	type plain streamEstimateConfig
+	if err := json.Unmarshal(b, (*plain)(c)); err != nil {
+		return fmt.Errorf("stream_usage_estimate must be true, false or an object: %w", err)
+	}
+	c.Enabled = true
+	return nil
+}
+
+type webhookConfig struct {
+	URL string `json:"url"`
+	// Timeout bounds each delivery attempt. Defaults to 5s.
+	Timeout duration `json:"timeout,omitempty"`
+	// MaxAttempts is how many times an event is tried before it is
+	// dead-lettered. Defaults to 3.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// Concurrency is how many deliveries the webhook's own workers run at
+	// once. Defaults to sink_workers.
+	Concurrency int `json:"concurrency,omitempty"`
+	// Secret, when set, signs each payload with HMAC-SHA256 in the
+	// X-Signature-256 header.
+	Secret string `json:"secret,omitempty"`
+}
+
+type dogStatsDConfig struct {
+	// Address is the agent's DogStatsD host:port, localhost:8125 by
+	// default.
+	Address string `json:"address,omitempty"`
+	// Tags are the event fields metrics are tagged by: model, provider,
+	// tenant and environment. Defaults to model, provider and tenant.
+	Tags []string `json:"tags,omitempty"`
+	// ConstantTags are added to every metric as is, e.g. env:prod.
+	ConstantTags []string `json:"constant_tags,omitempty"`
+	// MaxPacketSize caps the bytes sent per UDP packet. Defaults to 1432,
+	// which fits a typical MTU.
+	MaxPacketSize int `json:"max_packet_size,omitempty"`
+}
+
+type grpcSinkConfig struct {
+	// Address is the service's gRPC target, e.g. usage-processor:9000.
+	Address string `json:"address"`
+	// Method is the full method name events are sent to. Defaults to
+	// /tokenextproc.v1.UsageSink/Record.
+	Method string `json:"method,omitempty"`
+	// Timeout bounds each call. Defaults to 5s.
+	Timeout duration `json:"timeout,omitempty"`
+	// TLS connects with TLS, verified against the system roots, instead of
+	// plaintext.
+	TLS bool `json:"tls,omitempty"`
+}
+
+type otlpConfig struct {
+	// Endpoint is the collector's gRPC target, e.g. otel-collector:4317.
+	Endpoint string `json:"endpoint"`
+	// Headers are sent with every export, e.g. for authentication.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Interval is how often totals are exported. Defaults to 60s.
+	Interval duration `json:"interval,omitempty"`
+	// Timeout bounds each export. Defaults to 10s.
+	Timeout duration `json:"timeout,omitempty"`
+	// ResourceAttributes describe this process, e.g. deployment.environment.
+	// service.name defaults to token-ext-proc.
+	ResourceAttributes map[string]string `json:"resource_attributes,omitempty"`
+	// TLS connects with TLS, verified against the system roots, instead of
+	// plaintext.
+	TLS bool `json:"tls,omitempty"`
+}
+
+type cloudWatchConfig struct {
+	// Namespace is the CloudWatch namespace, token-ext-proc by default.
+	Namespace string `json:"namespace,omitempty"`
+	// Dimensions are the event fields metrics are split by: model, tenant
+	// and environment. Defaults to model and tenant.
+	Dimensions []string `json:"dimensions,omitempty"`
+	// MetricNames maps the event fields to emit to their CloudWatch metric
+	// names. Defaults to prompt, completion and total tokens and cost.
+	MetricNames map[string]string `json:"metric_names,omitempty"`
+	// Path is a file EMF lines are appended to, for the CloudWatch agent to
+	// tail, instead of stdout.
+	Path string `json:"path,omitempty"`
+}
+
+type syslogConfig struct {
+	// Network is udp (default), tcp or unix.
+	Network string `json:"network,omitempty"`
+	Address string `json:"address"`
+	// Facility and Severity are syslog names, e.g. local0 and info
+	// (the defaults).
+	Facility string `json:"facility,omitempty"`
+	Severity string `json:"severity,omitempty"`
+	// Format is json (default), with the event as the message, or kv, with
+	// its fields as structured data.
+	Format string `json:"format,omitempty"`
+}
+
+type sqliteConfig struct {
+	Path          string   `json:"path"`
+	FlushInterval duration `json:"flush_interval,omitempty"`
+}
+
+// duration is a time.Duration that unmarshals from strings like "5s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"5s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// loadConfig reads the config file at path, if any, then validates it and
+// fills in defaults. Validation reports every problem found, not just the
+// first.
+func loadConfig(path string) (*config, error) {
+	cfg := &config{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config: %w", err)
+		}
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing config %s: %w", path, err)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *config) validate() error {
+	var errs []error
+	for model, limit := range cfg.ModelConcurrency {
+		if limit <= 0 {
+			errs = append(errs, fmt.Errorf("model_concurrency for %q must be positive, got %d", model, limit))
+		}
+	}
+	if cfg.RateLimit != nil {
+		if cfg.RateLimit.QPS <= 0 {
+			errs = append(errs, fmt.Errorf("rate_limit.qps must be positive, got %v", cfg.RateLimit.QPS))
+		}
+		if cfg.RateLimit.Burst < 0 {
+			errs = append(errs, fmt.Errorf("rate_limit.burst must not be negative, got %d", cfg.RateLimit.Burst))
+		}
+		if cfg.RateLimit.Burst == 0 {
+			cfg.RateLimit.Burst = max(int(math.Ceil(cfg.RateLimit.QPS)), 1)
+		}
+	}
+	for _, name := range cfg.Parsers {
+		if lookupParser(name) == nil {
+			errs = append(errs, fmt.Errorf("parsers: unknown parser %q", name))
+		}
+	}
+	switch cfg.ParseFailureMode {
+	case "", "pass":
+	case "reject":
+		if len(cfg.Parsers) == 0 {
+			errs = append(errs, fmt.Errorf("parse_failure_mode: reject requires parsers"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("parse_failure_mode must be pass or reject, got %q", cfg.ParseFailureMode))
+	}
+	if _, ok := configPb.HeaderValueOption_HeaderAppendAction_value[cfg.HeaderAppendAction]; cfg.HeaderAppendAction != "" && !ok {
+		errs = append(errs, fmt.Errorf("header_append_action must be APPEND_IF_EXISTS_OR_ADD, ADD_IF_ABSENT, OVERWRITE_IF_EXISTS_OR_ADD or OVERWRITE_IF_EXISTS, got %q", cfg.HeaderAppendAction))
+	}
+	if cfg.MaxHeaderValueLength < 0 || cfg.MaxHeaderValueLength > 0 && cfg.MaxHeaderValueLength < len(truncatedMarker)+1 {
+		errs = append(errs, fmt.Errorf("max_header_value_length must be at least %d, got %d", len(truncatedMarker)+1, cfg.MaxHeaderValueLength))
+	}
+	switch cfg.ProcessingID {
+	case "", processingIDUUID, processingIDULID:
+	default:
+		errs = append(errs, fmt.Errorf("processing_id must be uuid or ulid, got %q", cfg.ProcessingID))
+	}
+	switch cfg.ZeroUsage {
+	case "":
+		cfg.ZeroUsage = zeroUsageEmit
+	case zeroUsageEmit, zeroUsageSkip, zeroUsageMark:
+	default:
+		errs = append(errs, fmt.Errorf("zero_usage must be emit, skip or mark, got %q", cfg.ZeroUsage))
+	}
+	switch cfg.ParserSelfTest {
+	case "", selfTestWarn, selfTestFail:
+	default:
+		errs = append(errs, fmt.Errorf("parser_self_test must be warn or fail, got %q", cfg.ParserSelfTest))
+	}
+	if cfg.ShadowParser != "" && lookupParser(cfg.ShadowParser) == nil {
+		errs = append(errs, fmt.Errorf("unknown shadow_parser %q", cfg.ShadowParser))
+	}
+	if cfg.MaxTokenCount < 0 {
+		errs = append(errs, fmt.Errorf("max_token_count must not be negative, got %d", cfg.MaxTokenCount))
+	}
+	if cfg.MaxTokenCount == 0 {
+		cfg.MaxTokenCount = defaultMaxTokenCount
+	}
+	if cfg.ModelPrefix != nil {
+		if cfg.ModelPrefix.Separator == "" {
+			cfg.ModelPrefix.Separator = defaultModelPrefixSeparator
+		}
+		hosts := make(map[string]string, len(cfg.ModelPrefix.Hosts))
+		for host, provider := range cfg.ModelPrefix.Hosts {
+			if provider == "" {
+				errs = append(errs, fmt.Errorf("model_prefix.hosts[%s]: provider is required", host))
+			}
+			hosts[strings.ToLower(host)] = provider
+		}
+		cfg.ModelPrefix.Hosts = hosts
+	}
+	for alias, model := range cfg.ModelAliases {
+		if model == "" {
+			errs = append(errs, fmt.Errorf("model_aliases[%s]: model is required", alias))
+		} else if _, ok := cfg.ModelAliases[model]; ok {
+			errs = append(errs, fmt.Errorf("model_aliases[%s]: %q is itself an alias", alias, model))
+		}
+	}
+	for i := range cfg.RequestSchemas {
+		rs := &cfg.RequestSchemas[i]
+		if rs.Path == "" || rs.Schema == "" {
+			errs = append(errs, fmt.Errorf("request_schemas[%d]: path and schema are required", i))
+		} else if err := rs.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("request_schemas[%d]: %w", i, err))
+		}
+	}
+	for model, size := range cfg.ContextWindows {
+		if size <= 0 {
+			errs = append(errs, fmt.Errorf("context_windows[%s] must be positive, got %d", model, size))
+		}
+	}
+	if cfg.ContextWarnThreshold < 0 {
+		errs = append(errs, fmt.Errorf("context_warn_threshold must not be negative, got %v", cfg.ContextWarnThreshold))
+	}
+	if cfg.ContextWarnThreshold == 0 {
+		cfg.ContextWarnThreshold = defaultContextWarnThreshold
+	}
+	if cfg.RequestIDHeader == "" {
+		cfg.RequestIDHeader = defaultRequestIDHeader
+	}
+	if cfg.MaxModelLabels < 0 {
+		errs = append(errs, fmt.Errorf("max_model_labels must not be negative, got %d", cfg.MaxModelLabels))
+	}
+	if cfg.MaxModelLabels == 0 {
+		cfg.MaxModelLabels = defaultLabelMaxValues
+	}
+	labelNames := map[string]bool{}
+	for i := range cfg.MetricLabelHeaders {
+		l := &cfg.MetricLabelHeaders[i]
+		if l.Header == "" {
+			errs = append(errs, fmt.Errorf("metric_label_headers[%d].header is required", i))
+		}
+		// caught here rather than by the registry, which panics at startup
+		name := l.labelName()
+		switch {
+		case name == "":
+			// reported above as a missing header
+		case name == "type" || name == "endpoint" || name == "attempt" || name == "environment":
+			errs = append(errs, fmt.Errorf("metric_label_headers[%d]: label %q is reserved", i, name))
+		case !model.LabelName(name).IsValidLegacy():
+			errs = append(errs, fmt.Errorf("metric_label_headers[%d]: %q is not a valid metric label name", i, name))
+		case labelNames[name]:
+			errs = append(errs, fmt.Errorf("metric_label_headers[%d]: label %q is already used", i, name))
+		}
+		labelNames[name] = true
+		if l.MaxValues == 0 {
+			l.MaxValues = defaultLabelMaxValues
+		}
+	}
+	for name := range cfg.StaticResponseHeaders {
+		if name == "" || strings.HasPrefix(name, ":") {
+			errs = append(errs, fmt.Errorf("static_response_headers: invalid header name %q", name))
+		} else if isComputedHeader(name) {
+			errs = append(errs, fmt.Errorf("static_response_headers: %q is set by the filter", name))
+		}
+	}
+	switch cfg.RequestReceivedAt {
+	case "", receivedAtRFC3339, receivedAtEpochMillis:
+	default:
+		errs = append(errs, fmt.Errorf("request_received_at must be %q or %q, got %q", receivedAtRFC3339, receivedAtEpochMillis, cfg.RequestReceivedAt))
+	}
+	errs = append(errs, validateLogLevels(cfg.LogLevels)...)
+	if cfg.AccountingMetadataFlag != "" {
+		if _, err := parseMetadataFlag(cfg.AccountingMetadataFlag); err != nil {
+			errs = append(errs, fmt.Errorf("accounting_metadata_flag: %w", err))
+		}
+	}
+	for i, rule := range cfg.LogRedactFields {
+		if _, err := parseRedactPath(rule); err != nil {
+			errs = append(errs, fmt.Errorf("log_redact_fields[%d]: %w", i, err))
+		}
+	}
+	errs = append(errs, validatePricing("pricing", cfg.Pricing)...)
+	for tenant, table := range cfg.TenantPricing {
+		errs = append(errs, validatePricing(fmt.Sprintf("tenant_pricing[%s]", tenant), table)...)
+	}
+	if len(cfg.TenantPricing) > 0 && cfg.TenantHeader == "" {
+		errs = append(errs, fmt.Errorf("tenant_pricing requires tenant_header"))
+	}
+	if len(cfg.TenantModels) > 0 && cfg.TenantHeader == "" {
+		errs = append(errs, fmt.Errorf("tenant_models requires tenant_header"))
+	}
+	if len(cfg.TenantModels) > 0 && !cfg.BufferRequestBody {
+		errs = append(errs, fmt.Errorf("tenant_models requires buffer_request_body"))
+	}
+	for tenant, models := range cfg.TenantModels {
+		if len(models) == 0 {
+			errs = append(errs, fmt.Errorf("tenant_models[%s] must list at least one model", tenant))
+		}
+	}
+	for model, r := range cfg.Credits {
+		switch {
+		case r.PerToken < 0 || r.Prompt < 0 || r.Completion < 0:
+			errs = append(errs, fmt.Errorf("credits[%s]: rates must not be negative", model))
+		case r.PerToken > 0 && (r.Prompt > 0 || r.Completion > 0):
+			errs = append(errs, fmt.Errorf("credits[%s]: per_token can't be combined with prompt and completion", model))
+		case r.PerToken == 0 && r.Prompt == 0 && r.Completion == 0:
+			errs = append(errs, fmt.Errorf("credits[%s]: per_token or prompt and completion are required", model))
+		}
+	}
+	if c := cfg.AvgTokensPerSecond; c != nil {
+		if c.Alpha == 0 {
+			c.Alpha = defaultThroughputAlpha
+		}
+		if c.Alpha < 0 || c.Alpha > 1 {
+			errs = append(errs, fmt.Errorf("avg_tokens_per_second.alpha must be in (0, 1], got %v", c.Alpha))
+		}
+	}
+	if cfg.RetryCostWindow < 0 {
+		errs = append(errs, fmt.Errorf("retry_cost_window must not be negative"))
+	}
+	if cfg.RetryCostWindow > 0 && len(cfg.Pricing) == 0 && len(cfg.TenantPricing) == 0 {
+		errs = append(errs, fmt.Errorf("retry_cost_window requires pricing"))
+	}
+	if cfg.Sampling != nil && (cfg.Sampling.Rate <= 0 || cfg.Sampling.Rate > 1) {
+		errs = append(errs, fmt.Errorf("sampling.rate must be in (0, 1], got %v", cfg.Sampling.Rate))
+	}
+	if cfg.AdaptiveBuffering != nil {
+		if cfg.AdaptiveBuffering.MaxBufferedBytes <= 0 {
+			errs = append(errs, fmt.Errorf("adaptive_buffering.max_buffered_bytes must be positive"))
+		}
+		for model, n := range cfg.AdaptiveBuffering.Models {
+			if n <= 0 {
+				errs = append(errs, fmt.Errorf("adaptive_buffering.models[%s] must be positive, got %d", model, n))
+			}
+		}
+	}
+	if cfg.RequestDecompressionLimitBytes < 0 {
+		errs = append(errs, fmt.Errorf("request_decompression_limit_bytes must not be negative"))
+	}
+	if cfg.BufferMemoryLimitBytes < 0 {
+		errs = append(errs, fmt.Errorf("buffer_memory_limit_bytes must not be negative"))
+	}
+	if cfg.ResponseTimeout < 0 {
+		errs = append(errs, fmt.Errorf("response_timeout must not be negative"))
+	}
+	if cfg.ResponseIdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("response_idle_timeout must not be negative"))
+	}
+	if cfg.ResponseIdleTimeout > 0 && cfg.ResponseTimeout > 0 && cfg.ResponseIdleTimeout >= cfg.ResponseTimeout {
+		errs = append(errs, fmt.Errorf("response_idle_timeout must be shorter than response_timeout"))
+	}
+	if cfg.MetricsFlushInterval < 0 {
+		errs = append(errs, fmt.Errorf("metrics_flush_interval must not be negative"))
+	}
+	if cfg.ProcessingBudget < 0 {
+		errs = append(errs, fmt.Errorf("processing_budget must not be negative"))
+	}
+	if cfg.ProcessingBudgetFastReturn && cfg.ProcessingBudget == 0 {
+		errs = append(errs, fmt.Errorf("processing_budget_fast_return requires processing_budget"))
+	}
+	if cfg.SinkWorkers <= 0 {
+		cfg.SinkWorkers = 4
+	}
+	if cfg.SinkQueueSize <= 0 {
+		cfg.SinkQueueSize = 1024
+	}
+	if c := cfg.Syslog; c != nil {
+		if c.Address == "" {
+			errs = append(errs, fmt.Errorf("syslog.address is required"))
+		}
+		if c.Network == "" {
+			c.Network = "udp"
+		}
+		if c.Facility == "" {
+			c.Facility = "local0"
+		}
+		if c.Severity == "" {
+			c.Severity = "info"
+		}
+		if c.Format == "" {
+			c.Format = "json"
+		}
+		if !slices.Contains([]string{"udp", "tcp", "unix"}, c.Network) {
+			errs = append(errs, fmt.Errorf("syslog.network must be udp, tcp or unix, got %q", c.Network))
+		}
+		if _, ok := syslogFacilities[c.Facility]; !ok {
+			errs = append(errs, fmt.Errorf("unknown syslog.facility %q", c.Facility))
+		}
+		if _, ok := syslogSeverities[c.Severity]; !ok {
+			errs = append(errs, fmt.Errorf("unknown syslog.severity %q", c.Severity))
+		}
+		if c.Format != "json" && c.Format != "kv" {
+			errs = append(errs, fmt.Errorf("syslog.format must be json or kv, got %q", c.Format))
+		}
+	}
+	if cfg.Tokenizer != nil {
+		if err := cfg.Tokenizer.load(); err != nil {
+			errs = append(errs, fmt.Errorf("tokenizer: %w", err))
+		}
+	}
+	if c := cfg.StreamUsageEstimate; c != nil && c.Enabled {
+		switch c.Estimator {
+		case "":
+			if c.Ratio != 0 {
+				errs = append(errs, fmt.Errorf("stream_usage_estimate.ratio requires an estimator"))
+			}
+		case "chars", "words":
+			if c.Ratio == 0 {
+				c.Ratio = defaultEstimatorRatios[c.Estimator]
+			}
+			if c.Ratio < 0 {
+				errs = append(errs, fmt.Errorf("stream_usage_estimate.ratio must be positive"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("stream_usage_estimate.estimator must be chars or words, got %q", c.Estimator))
+		}
+	}
+	if c := cfg.Webhook; c != nil {
+		if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("webhook.url must be an http or https URL, got %q", c.URL))
+		}
+		if c.Timeout < 0 || c.MaxAttempts < 0 || c.Concurrency < 0 {
+			errs = append(errs, fmt.Errorf("webhook: timeout, max_attempts and concurrency must not be negative"))
+		}
+		if c.Timeout == 0 {
+			c.Timeout = duration(5 * time.Second)
+		}
+		if c.MaxAttempts == 0 {
+			c.MaxAttempts = 3
+		}
+		if c.Concurrency == 0 {
+			c.Concurrency = cfg.SinkWorkers
+		}
+	}
+	if c := cfg.DogStatsD; c != nil {
+		if c.Address == "" {
+			c.Address = "localhost:8125"
+		}
+		if c.Tags == nil {
+			c.Tags = []string{"model", "provider", "tenant"}
+		}
+		if c.MaxPacketSize == 0 {
+			c.MaxPacketSize = 1432
+		}
+		if c.MaxPacketSize < 0 {
+			errs = append(errs, fmt.Errorf("dogstatsd.max_packet_size must be positive"))
+		}
+		for _, t := range c.Tags {
+			if !slices.Contains(dogStatsDTags, t) {
+				errs = append(errs, fmt.Errorf("dogstatsd.tags: unknown tag %q, must be one of %s", t, strings.Join(dogStatsDTags, ", ")))
+			}
+		}
+		for _, t := range c.ConstantTags {
+			if t == "" || strings.ContainsAny(t, ",|#\n") {
+				errs = append(errs, fmt.Errorf("dogstatsd.constant_tags: invalid tag %q", t))
+			}
+		}
+	}
+	if c := cfg.GRPCSink; c != nil {
+		if c.Address == "" {
+			errs = append(errs, fmt.Errorf("grpc_sink.address is required"))
+		}
+		if c.Method == "" {
+			c.Method = defaultGRPCSinkMethod
+		}
+		if !strings.HasPrefix(c.Method, "/") || strings.Count(c.Method, "/") != 2 {
+			errs = append(errs, fmt.Errorf("grpc_sink.method must be /package.Service/Method, got %q", c.Method))
+		}
+		if c.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("grpc_sink.timeout must not be negative"))
+		}
+		if c.Timeout == 0 {
+			c.Timeout = duration(5 * time.Second)
+		}
+	}
+	if c := cfg.OTLP; c != nil {
+		if c.Endpoint == "" {
+			errs = append(errs, fmt.Errorf("otlp.endpoint is required"))
+		}
+		if c.Interval < 0 || c.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("otlp: interval and timeout must not be negative"))
+		}
+		if c.Interval == 0 {
+			c.Interval = duration(time.Minute)
+		}
+		if c.Timeout == 0 {
+			c.Timeout = duration(10 * time.Second)
+		}
+		if c.ResourceAttributes == nil {
+			c.ResourceAttributes = map[string]string{}
+		}
+		if c.ResourceAttributes["service.name"] == "" {
+			c.ResourceAttributes["service.name"] = "token-ext-proc"
+		}
+	}
+	if c := cfg.CloudWatchEMF; c != nil {
+		if c.Path != "" {
+			if _, err := os.Stat(filepath.Dir(c.Path)); err != nil {
+				errs = append(errs, fmt.Errorf("cloudwatch_emf.path directory: %w", err))
+			}
+		}
+		if c.Namespace == "" {
+			c.Namespace = "token-ext-proc"
+		}
+		if c.Dimensions == nil {
+			c.Dimensions = []string{"model", "tenant"}
+		}
+		if c.MetricNames == nil {
+			c.MetricNames = maps.Clone(defaultCloudWatchMetrics)
+		}
+		for _, d := range c.Dimensions {
+			if !slices.Contains(cloudWatchDimensions, d) {
+				errs = append(errs, fmt.Errorf("cloudwatch_emf.dimensions: unknown dimension %q, must be one of %s", d, strings.Join(cloudWatchDimensions, ", ")))
+			}
+		}
+		for field, name := range c.MetricNames {
+			if _, ok := cloudWatchFields[field]; !ok {
+				errs = append(errs, fmt.Errorf("cloudwatch_emf.metric_names: unknown field %q", field))
+			}
+			if name == "" {
+				errs = append(errs, fmt.Errorf("cloudwatch_emf.metric_names[%s]: name is required", field))
+			}
+		}
+	}
+	if cfg.SQLite != nil {
+		if cfg.SQLite.Path == "" {
+			errs = append(errs, fmt.Errorf("sqlite.path is required"))
+		} else if _, err := os.Stat(filepath.Dir(cfg.SQLite.Path)); err != nil {
+			errs = append(errs, fmt.Errorf("sqlite.path directory: %w", err))
+		}
+		if cfg.SQLite.FlushInterval < 0 {
+			errs = append(errs, fmt.Errorf("sqlite.flush_interval must not be negative"))
+		}
+		if cfg.SQLite.FlushInterval == 0 {
+			cfg.SQLite.FlushInterval = duration(5 * time.Second)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkStdout rejects sending both NDJSON usage events (-usage-stdout) and
+// EMF lines to stdout, where they would interleave on one stream that log
+// drivers can't split.
+func (cfg *config) checkStdout(usageStdout bool) error {
+	if usageStdout && cfg.CloudWatchEMF != nil && cfg.CloudWatchEMF.Path == "" {
+		return errors.New("-usage-stdout and cloudwatch_emf both write to stdout; set cloudwatch_emf.path")
+	}
+	return nil
+}
+
+func validatePricing(field string, table pricingTable) []error {
+	var errs []error
+	for model, p := range table {
+		if p.Prompt < 0 || p.Completion < 0 || p.Embedding < 0 || p.CacheRead < 0 || p.CacheWrite < 0 {
+			errs = append(errs, fmt.Errorf("%s[%s]: rates must not be negative", field, model))
+		}
+		var prev int64
+		for i, t := range p.Tiers {
+			last := i == len(p.Tiers)-1
+			switch {
+			case t.Prompt < 0 || t.Completion < 0:
+				errs = append(errs, fmt.Errorf("%s[%s].tiers[%d]: rates must not be negative", field, model, i))
+			case last && t.UpTo != 0:
+				errs = append(errs, fmt.Errorf("%s[%s].tiers[%d]: the last tier must not set up_to", field, model, i))
+			case !last && t.UpTo <= prev:
+				errs = append(errs, fmt.Errorf("%s[%s].tiers[%d]: up_to must be greater than the previous tier's", field, model, i))
+			}
+			prev = t.UpTo
+		}
+	}
+	return errs
+}
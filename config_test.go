@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// configError loads yaml as a -config file and returns the validation error.
+func configError(t *testing.T, yaml string) error {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := loadConfig(path)
+	return err
+}
+
+func TestSQLiteFlushIntervalConfig(t *testing.T) {
+	dir := t.TempDir()
+	if err := configError(t, "sqlite: {path: "+filepath.Join(dir, "usage.db")+", flush_interval: -1s}"); err == nil || !strings.Contains(err.Error(), "sqlite.flush_interval") {
+		t.Errorf("negative flush_interval: got %v, want a sqlite.flush_interval error", err)
+	}
+	cfg := testConfig(t, "sqlite: {path: "+filepath.Join(dir, "usage.db")+"}")
+	if got := cfg.SQLite.FlushInterval; got <= 0 {
+		t.Errorf("default flush_interval = %v, want positive", got)
+	}
+}
+
+func TestCloudWatchEMFStdoutConflict(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "emf.log")
+	tests := []struct {
+		name        string
+		config      string
+		usageStdout bool
+		wantErr     bool
+	}{
+		{name: "emf alone", config: "cloudwatch_emf: {}"},
+		{name: "usage stdout alone", usageStdout: true},
+		{name: "both on stdout", config: "cloudwatch_emf: {}", usageStdout: true, wantErr: true},
+		{name: "emf to a file", config: "cloudwatch_emf: {path: " + path + "}", usageStdout: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := testConfig(t, tt.config).checkStdout(tt.usageStdout)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkStdout(%v) = %v, want error %v", tt.usageStdout, err, tt.wantErr)
+			}
+		})
+	}
+	if err := configError(t, "cloudwatch_emf: {path: /nonexistent/dir/emf.log}"); err == nil || !strings.Contains(err.Error(), "cloudwatch_emf.path") {
+		t.Errorf("missing directory: got %v, want a cloudwatch_emf.path error", err)
+	}
+}
+
+func TestCloudWatchEMFPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "emf.log")
+	cfg := testConfig(t, "cloudwatch_emf: {path: "+path+"}")
+	sinks, err := newSinks(cfg, newMetrics(prometheus.NewRegistry(), "", nil, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sinks.Record(usageEvent{Model: "gpt-4o", tokenUsage: tokenUsage{PromptTokens: 12, CompletionTokens: 5, TotalTokens: 17}})
+	if err := sinks.Close(); err != nil {
+		t.Fatal(err)
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), `"_aws"`) {
+		t.Errorf("emf file = %q, want an EMF line", body)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+// creditRate converts a model's tokens to billing credits. PerToken
+// applies to total tokens; Prompt and Completion weight each kind
+// separately instead.
+type creditRate struct {
+	PerToken   float64 `json:"per_token,omitempty"`
+	Prompt     float64 `json:"prompt,omitempty"`
+	Completion float64 `json:"completion,omitempty"`
+}
+
+// credits returns the credits u is billed at. Reasoning tokens are part of
+// CompletionTokens and so are weighted as completion.
+func (r creditRate) credits(u *tokenUsage) float64 {
+	if r.PerToken > 0 {
+		return float64(u.TotalTokens) * r.PerToken
+	}
+	return float64(u.PromptTokens)*r.Prompt + float64(u.CompletionTokens)*r.Completion
+}
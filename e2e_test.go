@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// serveTest serves s as main does, on an ephemeral port, and returns a
+// client for it.
+func serveTest(t *testing.T, s *server, authToken string) extProcPb.ExternalProcessorClient {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := newGRPCServer(s, authToken)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return extProcPb.NewExternalProcessorClient(conn)
+}
+
+// exchange sends frames over one Process stream, reading the response to
+// each before sending the next.
+func exchange(ctx context.Context, client extProcPb.ExternalProcessorClient, frames []*extProcPb.ProcessingRequest, opts ...grpc.CallOption) ([]*extProcPb.ProcessingResponse, error) {
+	stream, err := client.Process(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var sent []*extProcPb.ProcessingResponse
+	for _, frame := range frames {
+		if err := stream.Send(frame); err != nil {
+			return nil, err
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		sent = append(sent, resp)
+	}
+	return sent, stream.CloseSend()
+}
+
+func TestEndToEnd(t *testing.T) {
+	// as with -grpc-gzip; the registry is shared with the client
+	enableGzip()
+	client := serveTest(t, newTestServer(t, testConfig(t, `
+pricing:
+  gpt-4o:
+    prompt: 2.50
+    completion: 10.00
+`)), "")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	frames := jsonExchange("/v1/chat/completions",
+		`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`,
+		string(readFixture(t, "chat_no_total.json")))
+	for name, opts := range map[string][]grpc.CallOption{
+		"plain": nil,
+		"gzip":  {grpc.UseCompressor("gzip")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			sent, err := exchange(ctx, client, frames, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			headers := setHeaders(sent[len(sent)-1])
+			want := map[string]string{
+				headerPromptTokens:     "12",
+				headerCompletionTokens: "5",
+				headerTotalTokens:      "17",
+				headerCostUSD:          "0.00008",
+			}
+			for name, v := range want {
+				if headers[name] != v {
+					t.Errorf("%s = %q, want %q", name, headers[name], v)
+				}
+			}
+		})
+	}
+}
+
+func TestEndToEndAuthToken(t *testing.T) {
+	client := serveTest(t, newTestServer(t, testConfig(t, "")), "secret")
+	frames := jsonExchange("/v1/chat/completions", `{"model":"gpt-4o"}`, string(readFixture(t, "chat_no_total.json")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := exchange(ctx, client, frames); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("without a token got %v, want Unauthenticated", err)
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	if _, err := exchange(ctx, client, frames); err != nil {
+		t.Errorf("with the token got %v", err)
+	}
+}
+
+func TestResponseIdleTimeout(t *testing.T) {
+	const idle = 20 * time.Millisecond
+	s := newTestServer(t, testConfig(t, "response_idle_timeout: 20ms"))
+	client := serveTest(t, s, "")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Process(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(frame *extProcPb.ProcessingRequest) *extProcPb.ProcessingResponse {
+		t.Helper()
+		if err := stream.Send(frame); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	events := strings.SplitAfter(string(readFixture(t, "chat_n3.sse")), "\n\n")
+	idleCount := func() float64 { return testutil.ToFloat64(s.metrics.missingEndOfStream.WithLabelValues("idle")) }
+	promptTokens := func() float64 {
+		return testutil.ToFloat64(s.metrics.tokens.WithLabelValues("prompt", endpointCompletions, "first"))
+	}
+
+	send(requestHeaders(":path", "/v1/chat/completions"))
+	send(requestBody(`{"model":"gpt-4o","stream":true}`))
+	send(responseHeaders(":status", "200", "content-type", "text/event-stream"))
+	// a pause before the usage chunk has arrived isn't the end of the response
+	send(responseBody(strings.Join(events[:4], ""), false))
+	time.Sleep(5 * idle)
+	if got := idleCount(); got != 0 {
+		t.Errorf("missing_end_of_stream_total{trigger=idle} = %v after a pause without usage, want 0", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.parses.WithLabelValues("sse", "failure")); got != 0 {
+		t.Errorf("parse failures = %v after a pause, want 0", got)
+	}
+
+	// once the usage chunk has arrived, going idle records it
+	send(responseBody(strings.Join(events[4:], ""), false))
+	for deadline := time.Now().Add(time.Second); idleCount() == 0 && time.Now().Before(deadline); {
+		time.Sleep(idle)
+	}
+	if got := idleCount(); got != 1 {
+		t.Fatalf("missing_end_of_stream_total{trigger=idle} = %v, want 1", got)
+	}
+	if got := promptTokens(); got != 11 {
+		t.Errorf("prompt tokens = %v after going idle, want 11", got)
+	}
+
+	// a late EndOfStream still gets the final body's usage headers, without
+	// recording it twice
+	last := send(responseBody("", true))
+	if got := setHeaders(last)[headerTotalTokens]; got != "18" {
+		t.Errorf("total tokens = %q, want 18", got)
+	}
+	if got := promptTokens(); got != 11 {
+		t.Errorf("prompt tokens = %v after EndOfStream, want 11", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.parses.WithLabelValues("sse", "success")); got != 1 {
+		t.Errorf("parse successes = %v, want 1", got)
+	}
+}
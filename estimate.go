@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// promptText returns the text of a request's messages (string or text-part
+// content) or legacy prompt, concatenated.
+func promptText(messages []json.RawMessage, prompt json.RawMessage) string {
+	var text strings.Builder
+	for _, raw := range messages {
+		var msg struct {
+			Content json.RawMessage `json:"content"`
+		}
+		if json.Unmarshal(raw, &msg) == nil {
+			appendText(&text, msg.Content)
+		}
+	}
+	appendText(&text, prompt)
+	return text.String()
+}
+
+// appendText appends the text of a string, an array of strings, or an array
+// of {"type": "text", "text": ...} parts. Anything else appends nothing.
+func appendText(text *strings.Builder, raw json.RawMessage) {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		text.WriteString(s)
+		return
+	}
+	var parts []json.RawMessage
+	if json.Unmarshal(raw, &parts) != nil {
+		return
+	}
+	for _, p := range parts {
+		var part struct {
+			Text string `json:"text"`
+		}
+		if json.Unmarshal(p, &s) == nil {
+			text.WriteString(s)
+		} else if json.Unmarshal(p, &part) == nil {
+			text.WriteString(part.Text)
+		}
+	}
+}
+
+// streamedText returns the generated text of an SSE or NDJSON stream: the
+// delta content of chat completion chunks, the text of legacy completion
+// chunks and the deltas of Responses API events.
+func streamedText(body []byte) string {
+	var text strings.Builder
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if data, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			line = bytes.TrimSpace(data)
+		}
+		var chunk struct {
+			Choices []struct {
+				Text  string `json:"text"`
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+			Delta json.RawMessage `json:"delta"`
+		}
+		if len(line) == 0 || json.Unmarshal(line, &chunk) != nil {
+			continue
+		}
+		for _, c := range chunk.Choices {
+			text.WriteString(c.Text)
+			text.WriteString(c.Delta.Content)
+		}
+		var delta string
+		if json.Unmarshal(chunk.Delta, &delta) == nil {
+			text.WriteString(delta)
+		}
+	}
+	return text.String()
+}
+
+// estimateStreamUsage estimates the usage of a stream that reported none:
+// completion tokens from its generated text and prompt tokens from the
+// request's estimate, if one was made. It returns nil if the stream
+// generated no text to estimate from.
+func estimateStreamUsage(body []byte, tok Tokenizer, model string, promptTokens int64) *tokenUsage {
+	text := streamedText(body)
+	if text == "" {
+		return nil
+	}
+	completion := int64(tok.CountTokens(model, text))
+	return &tokenUsage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completion,
+		TotalTokens:      promptTokens + completion,
+		Estimated:        true,
+	}
+}
+
+// on reports whether stream usage estimation is enabled.
+func (c *streamEstimateConfig) on() bool {
+	return c != nil && c.Enabled
+}
+
+// tokenizer returns what stream usage is estimated with: the estimator the
+// config names, if any, else tok. It returns nil when estimation is off.
+func (c *streamEstimateConfig) tokenizer(tok Tokenizer) Tokenizer {
+	switch {
+	case !c.on():
+		return nil
+	case c.Estimator == "chars":
+		return heuristicTokenizer{charsPerToken: c.Ratio}
+	case c.Estimator == "words":
+		return wordsTokenizer{tokensPerWord: c.Ratio}
+	}
+	return tok
+}
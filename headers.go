@@ -0,0 +1,196 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	configPb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+)
+
+// Usage headers set on decorated responses.
+const (
+	headerPromptTokens     = "x-kuadrant-openai-prompt-tokens"
+	headerTotalTokens      = "x-kuadrant-openai-total-tokens"
+	headerCompletionTokens = "x-kuadrant-openai-completion-tokens"
+	headerReasoningTokens  = "x-openai-reasoning-tokens"
+	headerFingerprint      = "x-llm-system-fingerprint"
+	headerCostUSD          = "x-llm-cost-usd"
+	headerCostEstimated    = "x-llm-cost-estimated"
+	headerRequestTotalCost = "x-llm-request-total-cost"
+	headerCredits          = "x-llm-credits"
+	// headerEstimatedMaxCost is set on requests, and echoed on responses,
+	// before the model runs.
+	headerEstimatedMaxCost = "x-llm-estimated-max-cost-usd"
+	headerChoicesCount     = "x-llm-choices-count"
+	headerModel            = "x-llm-model"
+	headerCacheReadTokens  = "x-llm-cache-read-tokens"
+	headerCacheWriteTokens = "x-llm-cache-write-tokens"
+	headerCacheHit         = "x-llm-cache-hit"
+	headerEstimateDelta    = "x-llm-estimate-delta-tokens"
+	headerContextUsage     = "x-llm-context-utilization"
+	headerWarning          = "x-llm-processing-warning"
+	headerRefused          = "x-llm-refused"
+	headerProvider         = "x-llm-provider"
+	headerTokensEstimated  = "x-llm-tokens-estimated"
+	headerZeroUsage        = "x-llm-zero-usage"
+	headerResponseFormat   = "x-llm-response-format"
+
+	headerAvgTokensPerSecond = "x-llm-avg-tokens-per-second"
+)
+
+// usageHeaders are the headers emitted from parsed usage.
+var usageHeaders = []string{
+	headerPromptTokens,
+	headerTotalTokens,
+	headerCompletionTokens,
+	headerReasoningTokens,
+	headerFingerprint,
+	headerCostUSD,
+	headerCostEstimated,
+	headerRequestTotalCost,
+	headerCredits,
+	headerAvgTokensPerSecond,
+	headerChoicesCount,
+	headerModel,
+	headerCacheReadTokens,
+	headerCacheWriteTokens,
+	headerCacheHit,
+	headerEstimateDelta,
+	headerContextUsage,
+	headerWarning,
+	headerRefused,
+	headerProvider,
+	headerTokensEstimated,
+	headerZeroUsage,
+	headerResponseFormat,
+}
+
+// computedHeaders are every response header the filter computes itself, which
+// static headers may not override.
+var computedHeaders = append([]string{
+	"content-length",
+	"baggage",
+	"x-trace-id",
+	"x-span-id",
+	headerRequestReceivedAt,
+	headerRequestHash,
+	headerErrorType,
+	headerEstimatedMaxCost,
+	headerProcessingID,
+}, usageHeaders...)
+
+// computedHeaderPrefixes are prefixes of response headers the filter
+// computes under names chosen at runtime, such as re-exposed Server-Timing
+// durations.
+var computedHeaderPrefixes = []string{
+	"x-llm-upstream-",
+}
+
+// isComputedHeader reports whether the filter computes the response header
+// name itself.
+func isComputedHeader(name string) bool {
+	name = strings.ToLower(name)
+	if slices.Contains(computedHeaders, name) {
+		return true
+	}
+	for _, prefix := range computedHeaderPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerAppendAction is how every header the filter sets combines with one
+// already present. Envoy's default, APPEND_IF_EXISTS_OR_ADD, adds a second
+// value when an upstream or another filter set the header too.
+var headerAppendAction = configPb.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD
+
+// setHeaderAppendAction sets headerAppendAction from its validated Envoy
+// enum name, keeping Envoy's default when name is empty. Like the log
+// levels, it is set once at startup.
+func setHeaderAppendAction(name string) {
+	if name != "" {
+		headerAppendAction = configPb.HeaderValueOption_HeaderAppendAction(configPb.HeaderValueOption_HeaderAppendAction_value[name])
+	}
+}
+
+// maxHeaderValueLength, when positive, caps the length of every header
+// value the filter sets. Like headerAppendAction, it is set once at startup.
+var maxHeaderValueLength int
+
+// truncatedMarker ends header values cut to maxHeaderValueLength.
+const truncatedMarker = "..."
+
+// truncateHeaderValue cuts value to maxHeaderValueLength bytes, the last of
+// them truncatedMarker, without splitting a UTF-8 character.
+func truncateHeaderValue(key, value string) string {
+	if maxHeaderValueLength <= 0 || len(value) <= maxHeaderValueLength {
+		return value
+	}
+	n := max(maxHeaderValueLength-len(truncatedMarker), 0)
+	for n > 0 && !utf8.RuneStart(value[n]) {
+		n--
+	}
+	processLog.Warnf("Truncating %d byte %s header value to %d bytes", len(value), key, maxHeaderValueLength)
+	return value[:n] + truncatedMarker
+}
+
+// headerOption builds a header to set on the response. Values are sent as
+// RawValue (seems to encounter this issue otherwise:
+// https://github.com/envoyproxy/envoy/issues/31555) and truncated to
+// maxHeaderValueLength.
+func headerOption(key, value string) *configPb.HeaderValueOption {
+	value = truncateHeaderValue(key, value)
+	return &configPb.HeaderValueOption{
+		Header: &configPb.HeaderValue{
+			Key:      key,
+			RawValue: []byte(value),
+		},
+		AppendAction: headerAppendAction,
+	}
+}
+
+// Treatments of all-zero usage.
+const (
+	zeroUsageEmit = "emit"
+	zeroUsageSkip = "skip"
+	zeroUsageMark = "mark"
+)
+
+// headerOriginalPath is where Envoy keeps the request's path from before a
+// route's prefix_rewrite or regex_rewrite.
+const headerOriginalPath = "x-envoy-original-path"
+
+// defaultRequestIDHeader is Envoy's own request id header.
+const defaultRequestIDHeader = "x-request-id"
+
+const headerRequestReceivedAt = "x-llm-request-received-at"
+
+// Formats for the x-llm-request-received-at header.
+const (
+	receivedAtRFC3339     = "rfc3339"
+	receivedAtEpochMillis = "epoch_ms"
+)
+
+// formatReceivedAt formats t for the x-llm-request-received-at header.
+func formatReceivedAt(format string, t time.Time) string {
+	if format == receivedAtEpochMillis {
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// staticHeaderOptions converts configured static headers to header options,
+// sorted by name so responses are deterministic.
+func staticHeaderOptions(headers map[string]string) []*configPb.HeaderValueOption {
+	opts := make([]*configPb.HeaderValueOption, 0, len(headers))
+	for _, name := range slices.Sorted(maps.Keys(headers)) {
+		opts = append(opts, headerOption(name, headers[name]))
+	}
+	return opts
+}
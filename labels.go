@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// overflowLabel replaces label values beyond a label's cardinality cap.
+const overflowLabel = "other"
+
+// defaultLabelMaxValues caps a header label when no max_values is configured.
+const defaultLabelMaxValues = 100
+
+// highCardinalityHeaders are headers that are effectively unique per request
+// or per client and make poor metric labels.
+var highCardinalityHeaders = map[string]bool{
+	"authorization":   true,
+	"cookie":          true,
+	"traceparent":     true,
+	"user-agent":      true,
+	"x-b3-traceid":    true,
+	"x-forwarded-for": true,
+	"x-real-ip":       true,
+	"x-request-id":    true,
+	":path":           true,
+
+	headerOriginalPath: true,
+}
+
+// headerLabel lifts a request header into a metric label.
+type headerLabel struct {
+	Header string `json:"header"`
+	// Label is the metric label name. Defaults to the header name with
+	// dashes replaced by underscores.
+	Label string `json:"label,omitempty"`
+	// MaxValues caps the distinct values recorded for the label; further
+	// values are recorded as "other".
+	MaxValues int `json:"max_values,omitempty"`
+}
+
+func (h headerLabel) labelName() string {
+	if h.Label != "" {
+		return h.Label
+	}
+	return strings.NewReplacer("-", "_", ":", "").Replace(strings.ToLower(h.Header))
+}
+
+// warnHighCardinalityHeaders logs a warning for each configured label header
+// known to be unsafe as a metric label.
+func warnHighCardinalityHeaders(labels []headerLabel) {
+	for _, l := range labels {
+		if highCardinalityHeaders[strings.ToLower(l.Header)] {
+			mainLog.Warnf("header %q is high-cardinality and a poor metric label; values beyond %d are recorded as %q",
+				l.Header, l.MaxValues, overflowLabel)
+		}
+	}
+}
+
+// labelCapper bounds the number of distinct values seen for a label, bucketing
+// anything past the cap into "other" to protect metric cardinality.
+type labelCapper struct {
+	max int
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func newLabelCapper(max int) *labelCapper {
+	return &labelCapper{max: max, seen: make(map[string]struct{})}
+}
+
+// value returns v if it is already tracked or there is room to track it, and
+// "other" otherwise.
+func (c *labelCapper) value(v string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.seen[v]; ok {
+		return v
+	}
+	if len(c.seen) >= c.max {
+		return overflowLabel
+	}
+	c.seen[v] = struct{}{}
+	return v
+}
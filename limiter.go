@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// concurrencyLimiter enforces per-model caps on in-flight requests, protecting
+// fragile upstreams from overload at the edge.
+type concurrencyLimiter struct {
+	sems     map[string]chan struct{}
+	inFlight *prometheus.GaugeVec
+}
+
+func newConcurrencyLimiter(limits map[string]int, inFlight *prometheus.GaugeVec) *concurrencyLimiter {
+	l := &concurrencyLimiter{
+		sems:     make(map[string]chan struct{}, len(limits)),
+		inFlight: inFlight,
+	}
+	for model, limit := range limits {
+		l.sems[model] = make(chan struct{}, limit)
+	}
+	return l
+}
+
+// acquire takes a slot for model without blocking. It returns a release func
+// and true on success, or false if the model is at its limit. Unlimited models
+// always succeed.
+func (l *concurrencyLimiter) acquire(model string) (func(), bool) {
+	sem, ok := l.sems[model]
+	if !ok {
+		return func() {}, true
+	}
+	select {
+	case sem <- struct{}{}:
+		l.inFlight.WithLabelValues(model).Inc()
+		return func() {
+			<-sem
+			l.inFlight.WithLabelValues(model).Dec()
+		}, true
+	default:
+		return nil, false
+	}
+}
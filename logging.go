@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// logLevel is a log message's severity. A component's messages below its
+// minimum level are dropped.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// defaultLogComponent is the log_levels key that sets the level of every
+// component not listed explicitly.
+const defaultLogComponent = "default"
+
+// logger is a named sub-logger. Its messages are tagged [Name], as all of
+// the filter's log lines are, and filtered by the component's level.
+type logger struct {
+	name string
+	// level is the minimum level logged, debug (everything) until
+	// configured.
+	level atomic.Int32
+}
+
+// loggers are all the named loggers, by lowercased name, so log_levels can
+// be validated and applied.
+var loggers = map[string]*logger{}
+
+func newLogger(name string) *logger {
+	l := &logger{name: name}
+	loggers[strings.ToLower(name)] = l
+	return l
+}
+
+var (
+	mainLog        = newLogger("Main")
+	processLog     = newLogger("Process")
+	parserLog      = newLogger("Parser")
+	healthLog      = newLogger("Health")
+	baggageLog     = newLogger("Baggage")
+	maintenanceLog = newLogger("Maintenance")
+	shadowLog      = newLogger("Shadow")
+	sinksLog       = newLogger("Sinks")
+	sqliteLog      = newLogger("SQLite")
+	stdoutLog      = newLogger("Stdout")
+	syslogLog      = newLogger("Syslog")
+	cloudWatchLog  = newLogger("CloudWatch")
+	panicLog       = newLogger("Panic")
+	webhookLog     = newLogger("Webhook")
+	dogStatsDLog   = newLogger("DogStatsD")
+	grpcSinkLog    = newLogger("GRPCSink")
+	otlpLog        = newLogger("OTLP")
+)
+
+// enabled reports whether messages at level are logged, for skipping work
+// that only feeds a log line.
+func (l *logger) enabled(level logLevel) bool {
+	return level >= logLevel(l.level.Load())
+}
+
+func (l *logger) logf(level logLevel, format string, args ...any) {
+	if !l.enabled(level) {
+		return
+	}
+	log.Printf("["+l.name+"] "+format, args...)
+}
+
+func (l *logger) Debugf(format string, args ...any) { l.logf(levelDebug, format, args...) }
+func (l *logger) Infof(format string, args ...any)  { l.logf(levelInfo, format, args...) }
+func (l *logger) Warnf(format string, args ...any)  { l.logf(levelWarn, "WARNING: "+format, args...) }
+func (l *logger) Errorf(format string, args ...any) { l.logf(levelError, format, args...) }
+
+// Fatalf logs regardless of level and exits.
+func (l *logger) Fatalf(format string, args ...any) {
+	log.Printf("["+l.name+"] "+format, args...)
+	os.Exit(1)
+}
+
+// validateLogLevels checks log_levels names known components and levels.
+func validateLogLevels(levels map[string]string) []error {
+	var errs []error
+	for component, level := range levels {
+		component = strings.ToLower(component)
+		if _, ok := loggers[component]; !ok && component != defaultLogComponent {
+			names := make([]string, 0, len(loggers))
+			for name := range loggers {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			errs = append(errs, fmt.Errorf("log_levels: unknown component %q, must be %q or one of %s", component, defaultLogComponent, strings.Join(names, ", ")))
+		}
+		if _, ok := logLevelNames[strings.ToLower(level)]; !ok {
+			errs = append(errs, fmt.Errorf("log_levels: %s: unknown level %q, must be debug, info, warn or error", component, level))
+		}
+	}
+	return errs
+}
+
+// setLogLevels applies validated log_levels: the default entry to every
+// component, then each component's own entry.
+func setLogLevels(levels map[string]string) {
+	byComponent := make(map[string]logLevel, len(levels))
+	for component, level := range levels {
+		byComponent[strings.ToLower(component)] = logLevelNames[strings.ToLower(level)]
+	}
+	for name, l := range loggers {
+		level, ok := byComponent[name]
+		if !ok {
+			level = byComponent[defaultLogComponent]
+		}
+		l.level.Store(int32(level))
+	}
+}
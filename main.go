@@ -2,16 +2,25 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -19,80 +28,518 @@ import (
 	configPb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	filterPb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
 	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typePb "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	healthPb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
-type server struct{}
+type server struct {
+	environment     string
+	requestIDHeader string
+	tenantHeader    string
+	pricing         pricing
+	// retryCosts, when set, accumulates the cost of a request's attempts.
+	retryCosts retryCostStore
+	credits    map[string]creditRate
+	// tenantModels restricts tenants to their listed models.
+	tenantModels map[string][]string
+	// preferOriginalPath uses x-envoy-original-path, when present, as the
+	// request path.
+	preferOriginalPath bool
+
+	sampling    *samplingConfig
+	buffering   *adaptiveBufferingConfig
+	passthrough *passthroughConfig
+	modelPrefix *modelPrefixConfig
+	// modelAliases maps request models to the canonical model used for
+	// pricing, labels and reporting.
+	modelAliases map[string]string
+	// processingIDFormat, when set, is the format of per-request
+	// processing ids.
+	processingIDFormat string
+	// accountingFlag, when set, is the metadata flag that turns processing
+	// off per route.
+	accountingFlag *metadataFlag
+	// throughput, when set, averages streaming tokens per second by model.
+	throughput *throughputAverages
+	// summary, when set, gets a line per recorded request.
+	summary *summaryWriter
+	// requestTokenizer counts request prompts for the features that need an
+	// estimate, and is nil when none do, so requests aren't tokenized for
+	// nothing. streamTokenizer, when set, estimates the usage of streams
+	// that report none.
+	requestTokenizer Tokenizer
+	streamTokenizer  Tokenizer
+
+	// metadataNamespace, when set, is the dynamic metadata namespace usage is
+	// written under for access logging.
+	metadataNamespace string
+
+	maintenance *maintenanceMode
+
+	traceIDHeaders    bool
+	traceExemplars    bool
+	bufferRequestBody bool
+	injectUsage       bool
+	usageBaggage      bool
+	detectRefusals    bool
+	estimateDelta     bool
+	warningHeader     bool
+	requestHash       bool
+	classifyErrors    bool
+	maxCostHeader     bool
+	providerHeader    bool
+	formatHeader      bool
+
+	// zeroUsage is how usage headers are emitted for all-zero usage:
+	// zeroUsageEmit, zeroUsageSkip or zeroUsageMark.
+	zeroUsage string
+
+	// parsers, when set, are the only parsers usage may be parsed with, and
+	// rejectUnparsed replaces 2xx responses that fail to parse with a 502.
+	parsers        []string
+	rejectUnparsed bool
+
+	// decompressLimit, when positive, is the most a gzip-encoded request
+	// body is decompressed to before parsing.
+	decompressLimit int64
+
+	// contextWindows are model context window sizes, for reporting context
+	// utilization above contextWarnThreshold.
+	contextWindows       map[string]int64
+	contextWarnThreshold float64
+
+	// requestSchemas validate request bodies by path prefix.
+	requestSchemas []requestSchema
+
+	// staticHeaders are set on every processed response body.
+	staticHeaders []*configPb.HeaderValueOption
+
+	// receivedAtFormat, when set, is the format of the
+	// x-llm-request-received-at header.
+	receivedAtFormat string
+
+	metrics     *metrics
+	limiter     *concurrencyLimiter
+	rateLimiter *rateLimiter
+	buffers     *bufferBudget
+	sinks       *multiSink
+
+	// redactor masks sensitive body fields in logs, when configured.
+	redactor *redactor
+
+	// shadowParser, when set, is run on every complete response body and
+	// compared against the default parser's result.
+	shadowParser string
+
+	responseTimeout     time.Duration
+	responseIdleTimeout time.Duration
+
+	// processingBudget is the most time the handler should spend on one
+	// frame; with budgetFastReturn, streams that exceed it are passed
+	// through unprocessed from then on.
+	processingBudget time.Duration
+	budgetFastReturn bool
+
+	strictTotalTokens bool
+	maxTokenCount     int64
+	clampTokenCounts  bool
+}
 type healthServer struct{}
 
 func (s *healthServer) Check(ctx context.Context, in *healthPb.HealthCheckRequest) (*healthPb.HealthCheckResponse, error) {
-	log.Printf("[HealthCheck] Received health check request: %+v", in)
+	healthLog.Infof("Received check request: %+v", in)
 	return &healthPb.HealthCheckResponse{Status: healthPb.HealthCheckResponse_SERVING}, nil
 }
 
 func (s *healthServer) Watch(in *healthPb.HealthCheckRequest, srv healthPb.Health_WatchServer) error {
-	log.Printf("[HealthWatch] Received watch request: %+v", in)
+	healthLog.Infof("Received watch request: %+v", in)
 	return status.Error(codes.Unimplemented, "Watch is not implemented")
 }
 
+func (s *healthServer) List(ctx context.Context, in *healthPb.HealthListRequest) (*healthPb.HealthListResponse, error) {
+	healthLog.Infof("Received list request: %+v", in)
+	return &healthPb.HealthListResponse{
+		Statuses: map[string]*healthPb.HealthCheckResponse{
+			"": {Status: healthPb.HealthCheckResponse_SERVING},
+		},
+	}, nil
+}
+
 func (s *server) Process(srv extProcPb.ExternalProcessor_ProcessServer) error {
-	log.Println("[Process] Starting processing loop")
+	state := newStreamState()
+	state.buffers = s.buffers
+	if s.processingIDFormat != "" {
+		state.processingID = newProcessingID(s.processingIDFormat)
+		processLog.Debugf("Starting processing loop %s", state.processingID)
+	} else {
+		processLog.Debugf("Starting processing loop")
+	}
+	defer func() {
+		if state.release != nil {
+			state.release()
+		}
+		s.buffers.release(state.bufferedBytes)
+		state.dropResponseBody()
+	}()
+	reqs := recvLoop(srv)
+	// armed by the first ResponseBody frame when a response timeout is set
+	var responseDeadline <-chan time.Time
+	// re-armed by every ResponseBody frame without EndOfStream when a
+	// response idle timeout is set
+	var idleDeadline <-chan time.Time
 	for {
-		req, err := srv.Recv()
+		var rr recvResult
+		select {
+		case rr = <-reqs:
+		case <-responseDeadline:
+			processLog.Warnf("Response not complete %s after first body frame, terminating stream", s.responseTimeout)
+			if s.flushPartialUsage(state) {
+				s.metrics.missingEndOfStream.WithLabelValues("response_timeout").Inc()
+			}
+			return status.Errorf(codes.DeadlineExceeded, "response not complete within %s", s.responseTimeout)
+		case <-idleDeadline:
+			idleDeadline = nil
+			// the upstream may have sent its last frame without EndOfStream;
+			// the stream stays open in case it was only slow
+			if s.recordIdleUsage(state) {
+				s.metrics.missingEndOfStream.WithLabelValues("idle").Inc()
+			}
+			continue
+		case <-srv.Context().Done():
+			return s.streamCanceled(srv.Context(), state)
+		}
+		req, err := rr.req, rr.err
 		if err == io.EOF {
-			log.Println("[Process] Received EOF, terminating processing loop")
+			processLog.Debugf("Received EOF, terminating processing loop")
 			return nil
 		}
+		if err != nil && srv.Context().Err() != nil {
+			return s.streamCanceled(srv.Context(), state)
+		}
 		if err != nil {
-			log.Printf("[Process] Error receiving request: %v", err)
+			processLog.Errorf("Error receiving request: %v", err)
 			return status.Errorf(codes.Unknown, "cannot receive stream request: %v", err)
 		}
 
-		log.Printf("[Process] Received request: %+v", req)
+		if processLog.enabled(levelDebug) {
+			processLog.Debugf("Received request: %+v", s.redactor.loggable(req))
+		}
+		state.observed = req.GetObservabilityMode()
+		frame, frameStart := frameName(req), time.Now()
+		if state.overBudget && s.budgetFastReturn {
+			processLog.Debugf("Stream is over the processing budget, passing %s through unprocessed", frame)
+			s.send(srv, state, continueResponse(req))
+			continue
+		}
 
 		var resp *extProcPb.ProcessingResponse
 
 		switch r := req.Request.(type) {
 		case *extProcPb.ProcessingRequest_RequestHeaders:
-			log.Println("[Process] Processing RequestHeaders")
+			processLog.Debugf("Processing RequestHeaders")
+			if s.accountingFlag != nil && !s.accountingFlag.enabled(req.GetMetadataContext()) {
+				processLog.Debugf("Token accounting disabled for the route by %s.%s metadata, passing request through", s.accountingFlag.namespace, s.accountingFlag.key)
+				s.metrics.requestModes.WithLabelValues("disabled").Inc()
+				resp = passthroughResponse()
+				break
+			}
+			if enabled, retryAfter := s.maintenance.state(); enabled {
+				processLog.Infof("Maintenance mode enabled, rejecting request")
+				resp = immediateResponse(typePb.StatusCode_ServiceUnavailable, "service under maintenance",
+					headerOption("retry-after", strconv.Itoa(retryAfter)))
+				break
+			}
+			if s.rateLimiter != nil {
+				ok, retryAfter := s.rateLimiter.allow()
+				if !ok {
+					processLog.Infof("Global rate limit exceeded, rejecting request")
+					s.metrics.rateLimitCalls.WithLabelValues("rejected").Inc()
+					resp = immediateResponse(typePb.StatusCode_TooManyRequests, "rate limit exceeded",
+						headerOption("retry-after", strconv.Itoa(retryAfter)))
+					break
+				}
+				s.metrics.rateLimitCalls.WithLabelValues("admitted").Inc()
+			}
+			state.receivedAt = time.Now()
+			state.path = headerValue(r.RequestHeaders.GetHeaders(), ":path")
+			if original := headerValue(r.RequestHeaders.GetHeaders(), headerOriginalPath); s.preferOriginalPath && original != "" {
+				processLog.Debugf("Using original path %s rather than rewritten %s", original, state.path)
+				state.path = original
+			}
+			if s.tenantHeader != "" {
+				state.tenant = headerValue(r.RequestHeaders.GetHeaders(), s.tenantHeader)
+			}
+			// a tenant restricted to some models can't skip the model check
+			// by sending a request that would otherwise pass through
+			_, restricted := s.tenantModels[state.tenant]
+			if !restricted && s.passthrough.matches(state.path, headerValue(r.RequestHeaders.GetHeaders(), "content-type")) {
+				processLog.Debugf("Passing through non-LLM request to %s", state.path)
+				s.metrics.requestModes.WithLabelValues("passthrough").Inc()
+				resp = passthroughResponse()
+				break
+			}
+			s.metrics.requestModes.WithLabelValues("processed").Inc()
+			state.requestID = headerValue(r.RequestHeaders.GetHeaders(), s.requestIDHeader)
+			if state.requestID == "" {
+				state.requestID = uuid.NewString()
+				processLog.Debugf("No %s header, generated request id %s", s.requestIDHeader, state.requestID)
+			}
+			if state.processingID != "" {
+				processLog.Debugf("Processing %s is request %s", state.processingID, state.requestID)
+			}
+			state.modelProvider = s.modelPrefix.provider(headerValue(r.RequestHeaders.GetHeaders(), ":authority"))
+			if s.providerHeader {
+				state.forcedProvider = headerValue(r.RequestHeaders.GetHeaders(), headerProvider)
+			}
+			if s.decompressLimit > 0 {
+				state.requestEncoding = headerValue(r.RequestHeaders.GetHeaders(), "content-encoding")
+			}
+			if v := headerValue(r.RequestHeaders.GetHeaders(), "x-envoy-attempt-count"); v != "" {
+				if n, err := strconv.Atoi(v); err == nil && n > 0 {
+					state.attempt = n
+				} else {
+					processLog.Warnf("Ignoring invalid x-envoy-attempt-count %q", v)
+				}
+			}
+			state.labelHeaders = make([]string, len(s.metrics.headerLabels))
+			for i, l := range s.metrics.headerLabels {
+				state.labelHeaders[i] = headerValue(r.RequestHeaders.GetHeaders(), l.Header)
+			}
+			if s.traceIDHeaders {
+				state.trace = newTraceContext(headerValue(r.RequestHeaders.GetHeaders(), "traceparent"))
+			}
+			if s.traceExemplars {
+				state.parentTrace = parseTraceparent(headerValue(r.RequestHeaders.GetHeaders(), "traceparent"))
+			}
+			state.sampleWeight, state.sampled = s.sampling.sample(state.path, state.requestID)
 			// pass through headers untouched
+			reqHeadersResp := &extProcPb.HeadersResponse{}
+			if s.receivedAtFormat != "" {
+				reqHeadersResp.Response = &extProcPb.CommonResponse{
+					HeaderMutation: &extProcPb.HeaderMutation{
+						SetHeaders: []*configPb.HeaderValueOption{
+							headerOption(headerRequestReceivedAt, formatReceivedAt(s.receivedAtFormat, state.receivedAt)),
+						},
+					},
+				}
+			}
 			resp = &extProcPb.ProcessingResponse{
 				Response: &extProcPb.ProcessingResponse_RequestHeaders{
-					RequestHeaders: &extProcPb.HeadersResponse{},
+					RequestHeaders: reqHeadersResp,
 				},
 			}
-			log.Println("[Process] RequestHeaders processed, passing through response unchanged")
+			if s.bufferRequestBody {
+				// ask Envoy for the whole request body so the prompt can be inspected
+				resp.ModeOverride = &filterPb.ProcessingMode{
+					RequestBodyMode:    filterPb.ProcessingMode_BUFFERED,
+					ResponseHeaderMode: filterPb.ProcessingMode_SEND,
+				}
+			}
+			processLog.Debugf("RequestHeaders processed, passing through response unchanged")
 
 		case *extProcPb.ProcessingRequest_RequestBody:
-			log.Println("[Process] Processing RequestBody")
+			processLog.Debugf("Processing RequestBody")
+			if rb := r.RequestBody; rb.EndOfStream && state.release == nil {
+				body := rb.Body
+				if state.requestEncoding != "" {
+					if decoded, err := decodeRequestBody(body, state.requestEncoding, s.decompressLimit); err != nil {
+						processLog.Warnf("Failed to decompress %s request body, treating it as plain: %v", state.requestEncoding, err)
+					} else {
+						body = decoded
+					}
+				}
+				// the buffered request body, and its decoded copy, count
+				// against the same budget as response bodies
+				inspected := len(rb.Body)
+				if len(body) != len(rb.Body) {
+					inspected += len(body)
+				}
+				state.bufferedBytes += inspected
+				s.buffers.grow(inspected)
+				if schema := schemaFor(s.requestSchemas, state.path); schema != nil {
+					if err := schema.validate(body); err != nil {
+						processLog.Infof("Request body failed schema validation: %v", err)
+						resp = immediateResponse(typePb.StatusCode_BadRequest, err.Error(),
+							headerOption("content-type", "text/plain"))
+						break
+					}
+				}
+				state.request = parseRequest(body, s.modelAliases, s.requestTokenizer)
+				state.model = state.request.Model
+				state.reportedModel = s.modelPrefix.qualify(state.modelProvider, state.model)
+				parserLog.Debugf("Parsed request: %+v", state.request)
+				if models, ok := s.tenantModels[state.tenant]; ok && !slices.Contains(models, state.model) {
+					processLog.Infof("Model %q is not allowed for tenant %q, rejecting request", state.model, state.tenant)
+					s.metrics.modelDenials.WithLabelValues(state.tenant).Inc()
+					resp = immediateResponse(typePb.StatusCode_Forbidden, fmt.Sprintf("model %q is not allowed", state.model))
+					break
+				}
+				release, ok := s.limiter.acquire(state.model)
+				if !ok {
+					processLog.Infof("Concurrency limit reached for model %q, rejecting request", state.model)
+					resp = immediateResponse(typePb.StatusCode_TooManyRequests, "concurrency limit reached for model "+state.model)
+					break
+				}
+				state.release = release
+				if s.requestHash {
+					state.requestHash = requestHash(body)
+				}
+				if s.maxCostHeader {
+					if quote, ok := s.pricing.maxCost(state.tenant, state.model, state.request); ok {
+						state.maxCostUSD = strconv.FormatFloat(quote.USD, 'f', -1, 64)
+					}
+				}
+			}
 			// pass body untouched
+			var setHeaders []*configPb.HeaderValueOption
+			var removeHeaders []string
+			if r.RequestBody.EndOfStream {
+				if state.requestHash != "" {
+					setHeaders = append(setHeaders, headerOption(headerRequestHash, state.requestHash))
+				}
+				if state.maxCostUSD != "" {
+					setHeaders = append(setHeaders, headerOption(headerEstimatedMaxCost, state.maxCostUSD))
+				} else if s.maxCostHeader {
+					// upstream spend checks must not trust a client's own estimate
+					removeHeaders = append(removeHeaders, headerEstimatedMaxCost)
+				}
+			}
+			bodyResp := &extProcPb.BodyResponse{}
+			if len(setHeaders) > 0 || len(removeHeaders) > 0 {
+				bodyResp.Response = &extProcPb.CommonResponse{
+					HeaderMutation: &extProcPb.HeaderMutation{SetHeaders: setHeaders, RemoveHeaders: removeHeaders},
+				}
+			}
 			resp = &extProcPb.ProcessingResponse{
 				Response: &extProcPb.ProcessingResponse_RequestBody{
-					RequestBody: &extProcPb.BodyResponse{},
+					RequestBody: bodyResp,
 				},
 			}
-			log.Println("[Process] RequestBody processed, passing through response unchanged")
+			processLog.Debugf("RequestBody processed, passing through response unchanged")
 
 		case *extProcPb.ProcessingRequest_ResponseHeaders:
-			log.Println("[Process] Processing ResponseHeaders, instructing Envoy to buffer response body")
-			// buffer the response body
+			respStatus := headerValue(r.ResponseHeaders.GetHeaders(), ":status")
+			if state.responseHeadersSeen {
+				// with some retry configs Envoy sends more than one
+				// ResponseHeaders frame; only the first sets the mode, but a
+				// different status means a retried response replaced the first
+				if respStatus != state.responseStatus {
+					processLog.Infof("Duplicate ResponseHeaders with new status %s (was %s), resetting response state", respStatus, state.responseStatus)
+					state.resetResponse(respStatus, headerValue(r.ResponseHeaders.GetHeaders(), "content-type"))
+				} else {
+					processLog.Debugf("Ignoring duplicate ResponseHeaders")
+				}
+				resp = &extProcPb.ProcessingResponse{
+					Response: &extProcPb.ProcessingResponse_ResponseHeaders{
+						ResponseHeaders: &extProcPb.HeadersResponse{},
+					},
+				}
+				break
+			}
+			state.responseHeadersSeen = true
+			state.resetResponse(respStatus, headerValue(r.ResponseHeaders.GetHeaders(), "content-type"))
+			state.responseBaggage = headerValue(r.ResponseHeaders.GetHeaders(), "baggage")
+			if v := headerValue(r.ResponseHeaders.GetHeaders(), "x-envoy-upstream-service-time"); v != "" {
+				if ms, err := strconv.ParseInt(v, 10, 64); err == nil && ms >= 0 {
+					state.upstreamServiceTime = ms
+					s.metrics.upstreamServiceTime.WithLabelValues(s.metrics.modelLabel(state.reportedModel)).Observe(float64(ms))
+				} else {
+					processLog.Warnf("Ignoring invalid x-envoy-upstream-service-time %q", v)
+				}
+			}
+			var respHeaders []*configPb.HeaderValueOption
+			if state.processingID != "" {
+				respHeaders = append(respHeaders, headerOption(headerProcessingID, state.processingID))
+			}
+			if s.traceIDHeaders {
+				respHeaders = append(respHeaders,
+					headerOption("x-trace-id", state.trace.traceID),
+					headerOption("x-span-id", state.trace.spanID))
+			}
+			for _, t := range parseServerTiming(headerValue(r.ResponseHeaders.GetHeaders(), "server-timing")) {
+				s.metrics.serverTimings.WithLabelValues(s.metrics.serverTimingCapper.value(t.Name)).Observe(t.DurationMS)
+				respHeaders = append(respHeaders, headerOption(serverTimingHeader(t.Name), strconv.FormatFloat(t.DurationMS, 'f', -1, 64)))
+			}
+			if s.receivedAtFormat != "" && !state.receivedAt.IsZero() {
+				respHeaders = append(respHeaders, headerOption(headerRequestReceivedAt, formatReceivedAt(s.receivedAtFormat, state.receivedAt)))
+			}
+			if state.requestHash != "" {
+				respHeaders = append(respHeaders, headerOption(headerRequestHash, state.requestHash))
+			}
+			if state.maxCostUSD != "" {
+				respHeaders = append(respHeaders, headerOption(headerEstimatedMaxCost, state.maxCostUSD))
+			}
+			headersResp := &extProcPb.HeadersResponse{}
+			if len(respHeaders) > 0 {
+				headersResp.Response = &extProcPb.CommonResponse{
+					HeaderMutation: &extProcPb.HeaderMutation{SetHeaders: respHeaders},
+				}
+			}
+			// buffer (or stream) the response body, unless sampling excluded this request
+			bodyMode := s.buffering.bodyMode(state.model, state.responseContentType, headerValue(r.ResponseHeaders.GetHeaders(), "content-length"))
+			state.responseBodyMode = bodyMode
+			if s.buffering != nil && bodyMode == filterPb.ProcessingMode_BUFFERED {
+				// a chunked or mislabelled body can still outgrow the limit
+				// its content-length was buffered under
+				state.responseLimit = s.buffering.maxBufferedBytes(state.model)
+			}
+			if state.sampled && s.buffers.exhausted() {
+				processLog.Debugf("Processing ResponseHeaders, buffer memory budget exhausted, skipping response body")
+				s.metrics.bufferSkipped.Inc()
+				bodyMode = filterPb.ProcessingMode_NONE
+			} else if state.sampled {
+				processLog.Debugf("Processing ResponseHeaders, instructing Envoy to send response body in %s mode", bodyMode)
+			} else {
+				processLog.Debugf("Processing ResponseHeaders, request not sampled, skipping response body")
+				bodyMode = filterPb.ProcessingMode_NONE
+			}
+			state.bodySkipped = bodyMode == filterPb.ProcessingMode_NONE
+			// the buffering contract: ResponseHeaders always carries a
+			// ModeOverride that SENDs headers and sets the body mode, and by
+			// default no other reply does (RequestHeaders sets one only for
+			// buffer_request_body or passthrough). Without it Envoy falls back
+			// to the filter's configured body mode, which may not send the
+			// body at all and so silently loses usage
 			resp = &extProcPb.ProcessingResponse{
 				Response: &extProcPb.ProcessingResponse_ResponseHeaders{
-					ResponseHeaders: &extProcPb.HeadersResponse{},
+					ResponseHeaders: headersResp,
 				},
 				ModeOverride: &filterPb.ProcessingMode{
-					ResponseHeaderMode: filterPb.ProcessingMode_SKIP,
-					ResponseBodyMode:   filterPb.ProcessingMode_BUFFERED,
+					ResponseHeaderMode: filterPb.ProcessingMode_SEND,
+					ResponseBodyMode:   bodyMode,
 				},
 			}
-			log.Println("[Process] ResponseHeaders processed, buffering response body")
+			processLog.Debugf("ResponseHeaders processed")
 
 		case *extProcPb.ProcessingRequest_ResponseBody:
-			log.Println("[Process] Processing ResponseBody")
+			processLog.Debugf("Processing ResponseBody")
 			rb := r.ResponseBody
-			log.Printf("[Process] ResponseBody received, EndOfStream: %v", rb.EndOfStream)
+			processLog.Debugf("ResponseBody received, EndOfStream: %v", rb.EndOfStream)
+			if state.observed && state.bodySkipped {
+				// observability mode ignores the ModeOverride that turned
+				// the body off, so Envoy sends it anyway
+				break
+			}
+			if state.responseStart.IsZero() {
+				state.responseStart = time.Now()
+				if s.responseTimeout > 0 {
+					responseDeadline = time.After(s.responseTimeout)
+				}
+			}
+			// accumulate chunks so usage can be parsed from the full body
+			// whether Envoy sends it BUFFERED or STREAMED
+			s.accumulateResponse(state, rb.Body)
 			if !rb.EndOfStream {
-				log.Println("[Process] ResponseBody not complete, continuing to buffer")
+				// only a streamed body arrives in several frames. Envoy uses
+				// its configured STREAMED mode when it doesn't allow the
+				// ModeOverride, so go by the frames rather than the override
+				state.responseBodyMode = filterPb.ProcessingMode_STREAMED
+				processLog.Debugf("ResponseBody not complete, continuing to buffer")
+				if s.responseIdleTimeout > 0 && !state.usageRecorded {
+					idleDeadline = time.After(s.responseIdleTimeout)
+				}
+				// an empty BodyResponse continues with the chunk unmodified,
+				// which is the reply Envoy expects to each streamed chunk
 				resp = &extProcPb.ProcessingResponse{
 					Response: &extProcPb.ProcessingResponse_ResponseBody{
 						ResponseBody: &extProcPb.BodyResponse{},
@@ -100,97 +547,724 @@ func (s *server) Process(srv extProcPb.ExternalProcessor_ProcessServer) error {
 				}
 				break
 			}
+			idleDeadline = nil
 
-			log.Println("[Process] Received complete ResponseBody, attempting to parse JSON for usage metrics")
-			// parse OpenAI-style usage metrics
-			var openAIResp struct {
-				Usage struct {
-					PromptTokens     int `json:"prompt_tokens"`
-					TotalTokens      int `json:"total_tokens"`
-					CompletionTokens int `json:"completion_tokens"`
-				} `json:"usage"`
+			if s.classifyErrors && !strings.HasPrefix(state.responseStatus, "2") {
+				if provider, errType := parseProviderError(state.responseBody); errType != "" {
+					processLog.Debugf("Upstream %s error of type %q", provider, errType)
+					s.metrics.providerErrors.WithLabelValues(provider, s.metrics.errorTypeCapper.value(errType)).Inc()
+					headers := append(slices.Clone(s.staticHeaders), headerOption(headerErrorType, errType))
+					resp = &extProcPb.ProcessingResponse{
+						Response: &extProcPb.ProcessingResponse_ResponseBody{
+							ResponseBody: &extProcPb.BodyResponse{
+								Response: &extProcPb.CommonResponse{
+									HeaderMutation: &extProcPb.HeaderMutation{SetHeaders: headers},
+								},
+							},
+						},
+					}
+					break
+				}
+			}
+
+			parserLog.Debugf("Received complete ResponseBody, attempting to parse usage metrics (content-type %q)", state.responseContentType)
+			var usage *tokenUsage
+			var err error
+			if state.responseOverflow != "" {
+				err = fmt.Errorf("response body outgrew the %s buffer limit", state.responseOverflow)
+			} else {
+				usage, err = s.parseResponseUsage(state)
 			}
-			err := json.Unmarshal(rb.Body, &openAIResp)
 			if err != nil {
-				log.Printf("[Process] Failed to unmarshal JSON: %v", err)
-				resp = &extProcPb.ProcessingResponse{
-					Response: &extProcPb.ProcessingResponse_ResponseBody{
-						ResponseBody: &extProcPb.BodyResponse{},
-					},
+				parserLog.Warnf("Failed to parse usage: %v", err)
+				if state.observed {
+					break
+				}
+				if s.rejectUnparsed && strings.HasPrefix(state.responseStatus, "2") && !state.usageRecorded {
+					resp = immediateResponse(typePb.StatusCode_BadGateway, "response usage could not be accounted for")
+					break
 				}
+				// fail open: an unparseable body, e.g. invalid JSON, passes
+				// through untouched, and without static or warning headers
+				// configured the response carries no header mutation at all
+				headers := slices.Clone(s.staticHeaders)
+				if s.warningHeader {
+					headers = append(headers, headerOption(headerWarning, "usage"))
+				}
+				if s.formatHeader {
+					headers = append(headers, headerOption(headerResponseFormat, state.responseFormat))
+				}
+				resp = responseBodyHeaders(headers)
+				break
+			}
+			parserLog.Debugf("Successfully parsed usage metrics: %+v", *usage)
+			zeroUsage := usage.PromptTokens == 0 && usage.CompletionTokens == 0 && usage.TotalTokens == 0
+			var ev usageEvent
+			if state.usageRecorded {
+				// recorded when the response went idle; EndOfStream turned up
+				// late, and the final body only decorates the response
+				processLog.Debugf("ResponseBody complete after usage was recorded, not recording it again")
+				ev = s.usageEvent(state, usage)
+			} else {
+				ev = s.recordUsage(state, usage)
+				s.observeUsage(state, usage)
+				if zeroUsage {
+					s.metrics.zeroUsage.WithLabelValues(s.metrics.modelLabel(state.reportedModel)).Inc()
+				}
+			}
+			if state.observed {
+				break
+			}
+			if zeroUsage && s.zeroUsage == zeroUsageSkip {
+				processLog.Debugf("Usage is all zero, not emitting usage headers")
+				resp = responseBodyHeaders(s.staticHeaders)
 				break
 			}
-
-			log.Printf("[Process] Successfully parsed usage metrics: %+v", openAIResp.Usage)
 
 			// decorate as headers
-			// send as RawValues (seems to encounter this issue otherwise: https://github.com/envoyproxy/envoy/issues/31555)
-			headers := []*configPb.HeaderValueOption{
-				{
-					Header: &configPb.HeaderValue{
-						Key:      "x-kuadrant-openai-prompt-tokens",
-						RawValue: []byte(strconv.Itoa(openAIResp.Usage.PromptTokens)),
-					},
-				},
-				{
-					Header: &configPb.HeaderValue{
-						Key:      "x-kuadrant-openai-total-tokens",
-						RawValue: []byte(strconv.Itoa(openAIResp.Usage.TotalTokens)),
-					},
-				},
-				{
-					Header: &configPb.HeaderValue{
-						Key:      "x-kuadrant-openai-completion-tokens",
-						RawValue: []byte(strconv.Itoa(openAIResp.Usage.CompletionTokens)),
-					},
-				},
+			headers := append(slices.Clone(s.staticHeaders),
+				headerOption(headerPromptTokens, strconv.FormatInt(usage.PromptTokens, 10)),
+				headerOption(headerTotalTokens, strconv.FormatInt(usage.TotalTokens, 10)),
+			)
+			// embeddings have no completion, so a 0 header would be misleading
+			if state.endpoint != endpointEmbeddings {
+				headers = append(headers, headerOption(headerCompletionTokens, strconv.FormatInt(usage.CompletionTokens, 10)))
+			}
+			if usage.ReasoningTokens > 0 {
+				headers = append(headers, headerOption(headerReasoningTokens, strconv.FormatInt(usage.ReasoningTokens, 10)))
+			}
+			if usage.SystemFingerprint != "" {
+				headers = append(headers, headerOption(headerFingerprint, usage.SystemFingerprint))
+			}
+			if usage.CacheReadTokens > 0 || usage.CacheWriteTokens > 0 {
+				headers = append(headers,
+					headerOption(headerCacheReadTokens, strconv.FormatInt(usage.CacheReadTokens, 10)),
+					headerOption(headerCacheWriteTokens, strconv.FormatInt(usage.CacheWriteTokens, 10)))
+			}
+			if usage.CacheReadTokens > 0 {
+				headers = append(headers, headerOption(headerCacheHit, "true"))
+			}
+			if ev.Model != "" {
+				headers = append(headers, headerOption(headerModel, ev.Model))
+			}
+			if estimate := state.request.EstimatedTokens; s.estimateDelta && estimate > 0 {
+				headers = append(headers, headerOption(headerEstimateDelta, strconv.FormatInt(usage.TotalTokens-estimate, 10)))
+			}
+			if window := s.contextWindows[state.model]; window > 0 {
+				utilization := float64(usage.PromptTokens) / float64(window)
+				headers = append(headers, headerOption(headerContextUsage, strconv.FormatFloat(utilization, 'f', 4, 64)))
+			}
+			if usage.Choices > 1 {
+				headers = append(headers, headerOption(headerChoicesCount, strconv.Itoa(usage.Choices)))
+			}
+			if s.detectRefusals && usage.Refusal != "" {
+				headers = append(headers, headerOption(headerRefused, "true"))
+			}
+			if s.providerHeader {
+				if provider := state.providerName(); provider != "" {
+					headers = append(headers, headerOption(headerProvider, provider))
+				}
+			}
+			if s.usageBaggage {
+				headers = append(headers, headerOption("baggage", mergeBaggage(state.responseBaggage, usageBaggage(state.model, usage))))
+			}
+			if usage.Estimated {
+				headers = append(headers, headerOption(headerTokensEstimated, "true"))
+			}
+			if s.formatHeader {
+				headers = append(headers, headerOption(headerResponseFormat, state.responseFormat))
+			}
+			if s.throughput != nil {
+				if avg, ok := s.throughput.average(s.metrics.modelLabel(state.reportedModel)); ok {
+					headers = append(headers, headerOption(headerAvgTokensPerSecond, strconv.FormatFloat(avg, 'f', 1, 64)))
+				}
+			}
+			if zeroUsage && s.zeroUsage == zeroUsageMark {
+				headers = append(headers, headerOption(headerZeroUsage, "true"))
+			}
+			if ev.priced {
+				headers = append(headers, headerOption(headerCostUSD, strconv.FormatFloat(ev.CostUSD, 'f', -1, 64)))
+				if ev.CostEstimated {
+					headers = append(headers, headerOption(headerCostEstimated, "true"))
+				}
+				if s.retryCosts != nil && !state.mayBeRetried() {
+					headers = append(headers, headerOption(headerRequestTotalCost, strconv.FormatFloat(ev.RequestTotalCostUSD, 'f', -1, 64)))
+				}
+			}
+			if ev.credited {
+				headers = append(headers, headerOption(headerCredits, strconv.FormatFloat(ev.Credits, 'f', -1, 64)))
+			}
+			common := &extProcPb.CommonResponse{}
+			// only a fully buffered body can be replaced; streamed chunks
+			// have already gone to the client. A mutation replaces just the
+			// frame it answers, so the body must also have arrived in this one
+			// frame, which a streamed body never does.
+			if s.injectUsage && state.responseBodyMode == filterPb.ProcessingMode_BUFFERED {
+				if body, ok, err := injectUsage(state.responseBody, usage); err != nil {
+					processLog.Warnf("Failed to inject usage into response body: %v", err)
+					state.warnings = append(state.warnings, "inject")
+				} else if ok {
+					common.BodyMutation = &extProcPb.BodyMutation{
+						Mutation: &extProcPb.BodyMutation_Body{Body: body},
+					}
+					headers = append(headers, headerOption("content-length", strconv.Itoa(len(body))))
+					processLog.Debugf("Injected usage into response body")
+				}
 			}
+			if s.warningHeader && len(state.warnings) > 0 {
+				headers = append(headers, headerOption(headerWarning, strings.Join(state.warnings, ",")))
+			}
+			common.HeaderMutation = &extProcPb.HeaderMutation{SetHeaders: headers}
 			resp = &extProcPb.ProcessingResponse{
 				Response: &extProcPb.ProcessingResponse_ResponseBody{
 					ResponseBody: &extProcPb.BodyResponse{
-						Response: &extProcPb.CommonResponse{
-							HeaderMutation: &extProcPb.HeaderMutation{
-								SetHeaders: headers,
-							},
-						},
+						Response: common,
 					},
 				},
 			}
-			log.Printf("[Process] ResponseBody processed and decorated with headers: %+v", headers)
+			processLog.Debugf("ResponseBody processed and decorated with headers: %+v", headers)
+
+			if s.metadataNamespace != "" {
+				resp.DynamicMetadata = usageMetadata(s.metadataNamespace, ev)
+			}
+
+		case *extProcPb.ProcessingRequest_RequestTrailers:
+			processLog.Debugf("Processing RequestTrailers, passing through unchanged")
+			resp = &extProcPb.ProcessingResponse{
+				Response: &extProcPb.ProcessingResponse_RequestTrailers{
+					RequestTrailers: &extProcPb.TrailersResponse{},
+				},
+			}
+
+		case *extProcPb.ProcessingRequest_ResponseTrailers:
+			processLog.Debugf("Processing ResponseTrailers, passing through unchanged")
+			resp = &extProcPb.ProcessingResponse{
+				Response: &extProcPb.ProcessingResponse_ResponseTrailers{
+					ResponseTrailers: &extProcPb.TrailersResponse{},
+				},
+			}
 
 		default:
-			log.Printf("[Process] Received unrecognized request type: %+v", r)
+			processLog.Warnf("Received unrecognized request type: %+v", r)
 			resp = &extProcPb.ProcessingResponse{}
 		}
 
-		if err := srv.Send(resp); err != nil {
-			log.Printf("[Process] Error sending response: %v", err)
-		} else {
-			log.Printf("[Process] Sent response: %+v", resp)
+		s.observeFrame(state, frame, time.Since(frameStart))
+		s.send(srv, state, resp)
+	}
+}
+
+// send sends resp, except in observability mode, where Envoy ignores it.
+func (s *server) send(srv extProcPb.ExternalProcessor_ProcessServer, state *streamState, resp *extProcPb.ProcessingResponse) {
+	if state.observed {
+		return
+	}
+	if err := srv.Send(resp); err != nil {
+		processLog.Errorf("Error sending response: %v", err)
+	} else if processLog.enabled(levelDebug) {
+		processLog.Debugf("Sent response: %+v", s.redactor.loggable(resp))
+	}
+}
+
+// observeFrame records how long the handler spent on a frame, and marks the
+// stream as over budget when that exceeds the processing budget.
+func (s *server) observeFrame(state *streamState, frame string, d time.Duration) {
+	s.metrics.frameDuration.WithLabelValues(frame).Observe(d.Seconds())
+	if s.processingBudget > 0 && d > s.processingBudget {
+		processLog.Warnf("Processing %s took %s, over the %s budget", frame, d, s.processingBudget)
+		s.metrics.budgetExceeded.WithLabelValues(frame).Inc()
+		state.overBudget = true
+	}
+}
+
+// observeUsage records the observations of a response's usage that are
+// independent of decorating the response.
+func (s *server) observeUsage(state *streamState, usage *tokenUsage) {
+	if estimate := state.request.EstimatedTokens; s.estimateDelta && estimate > 0 {
+		s.metrics.estimateRatio.Observe(float64(usage.TotalTokens) / float64(estimate))
+	}
+	if window := s.contextWindows[state.model]; window > 0 {
+		utilization := float64(usage.PromptTokens) / float64(window)
+		s.metrics.contextUtilization.Observe(utilization)
+		if utilization > s.contextWarnThreshold {
+			processLog.Warnf("request %s to %s used %.0f%% of the context window (%d/%d prompt tokens)",
+				state.requestID, state.model, utilization*100, usage.PromptTokens, window)
 		}
 	}
+	if s.detectRefusals && usage.Refusal != "" {
+		s.metrics.refusals.WithLabelValues(usage.Refusal).Inc()
+	}
+	// only a streamed response's duration reflects generation; a buffered
+	// one arrives all at once
+	if s.throughput != nil && state.responseBodyMode == filterPb.ProcessingMode_STREAMED && strings.HasPrefix(state.responseStatus, "2") {
+		s.throughput.observe(s.metrics.modelLabel(state.reportedModel), usage.CompletionTokens, time.Since(state.responseStart))
+	}
 }
 
-func main() {
-	lis, err := net.Listen("tcp", ":50051")
+// parseResponseUsage parses and validates usage from the response body
+// accumulated so far.
+func (s *server) parseResponseUsage(state *streamState) (*tokenUsage, error) {
+	parser, fellBack := parserFor(state.responseContentType)
+	state.provider = parser.Name
+	state.responseFormat = parser.Name
+	if fellBack {
+		state.responseFormat += ";fallback"
+	}
+	// usage recorded when the response went idle is parsed again at a late
+	// EndOfStream, which mustn't count the response twice
+	counted := !state.usageRecorded
+	defer func() {
+		if counted {
+			s.metrics.responseFormats.WithLabelValues(state.responseFormat).Inc()
+		}
+	}()
+	if s.parsers != nil && !slices.Contains(s.parsers, parser.Name) {
+		if counted {
+			s.metrics.parses.WithLabelValues(state.provider, "disabled").Inc()
+		}
+		return nil, fmt.Errorf("parser %s for content type %q is not enabled", parser.Name, state.responseContentType)
+	}
+	usage, err := parser.parse(state.responseBody)
+	if s.shadowParser != "" && counted {
+		s.shadowParse(state.responseBody, usage, err)
+	}
+	if err != nil && s.streamTokenizer != nil && (parser.Name == "sse" || parser.Name == "ndjson") {
+		if est := estimateStreamUsage(state.responseBody, s.streamTokenizer, state.model, state.request.EstimatedPromptTokens); est != nil {
+			parserLog.Debugf("No usage in %s stream, estimated %+v", parser.Name, *est)
+			usage, err = est, nil
+			state.responseFormat += ";estimated"
+		}
+	}
+	// the total is derived first so a derived total is range-checked too
+	if err == nil && !s.strictTotalTokens {
+		usage.deriveTotal()
+	}
+	if err == nil {
+		err = usage.validate(s.maxTokenCount, s.clampTokenCounts)
+	}
+	if err == nil && s.parsers != nil && strings.HasPrefix(state.responseStatus, "2") &&
+		usage.PromptTokens == 0 && usage.CompletionTokens == 0 && usage.TotalTokens == 0 &&
+		isUsageEndpoint(state.path, state.responseContentType, state.responseBody) {
+		err = errors.New("no usage in response")
+	}
+	if err != nil {
+		if counted {
+			s.metrics.parses.WithLabelValues(state.provider, "failure").Inc()
+		}
+		return nil, err
+	}
+	if counted {
+		s.metrics.parses.WithLabelValues(state.provider, "success").Inc()
+	}
+	state.endpoint = detectEndpoint(state.path, state.responseContentType, state.responseBody)
+	if state.modelProvider == "" {
+		// the request's host isn't mapped, so prefix with the provider the
+		// response came from
+		state.reportedModel = s.modelPrefix.qualify(state.providerName(), state.model)
+	}
+	return usage, nil
+}
+
+// recordUsage records parsed usage to metrics and sinks, returning the usage
+// event. Usage from a failed attempt that Envoy may retry is left out so only
+// the final attempt is counted.
+func (s *server) recordUsage(state *streamState, usage *tokenUsage) usageEvent {
+	state.usageRecorded = true
+	ev := s.usageEvent(state, usage)
+	if !ev.priced && s.pricing.configured() {
+		state.warnings = append(state.warnings, "pricing")
+	}
+	if s.retryCosts != nil && ev.priced {
+		ev.RequestTotalCostUSD = s.retryCosts.add(state.requestID, ev.CostUSD)
+	}
+	if state.mayBeRetried() {
+		processLog.Debugf("Not recording usage of attempt %d with status %s, it may be retried", state.attempt, state.responseStatus)
+		return ev
+	}
+	if s.summary != nil {
+		s.summary.write(ev, state.responseStatus, time.Since(state.receivedAt))
+	}
+	s.metrics.recordTokens(state.endpoint, state.retry(), state.labelHeaders, usage, state.sampleWeight)
+	s.metrics.recordCostTiers(ev.Model, ev.costTiers, state.sampleWeight)
+	if ev.credited {
+		s.metrics.credits.WithLabelValues(s.metrics.modelLabel(ev.Model)).Add(ev.Credits * state.sampleWeight)
+	}
+	s.metrics.observeRequestTokens(state.endpoint, ev.Provider, ev.Model, state.exemplar(), usage)
+	if !s.sinks.Record(ev) {
+		state.warnings = append(state.warnings, "sink")
+	}
+	return ev
+}
+
+// streamCanceled ends a stream whose context is done, usually because Envoy
+// cancelled it when the client disconnected. That is routine, so it is
+// logged at debug; any usage received so far is still recorded.
+func (s *server) streamCanceled(ctx context.Context, state *streamState) error {
+	processLog.Debugf("Stream cancelled: %v", context.Cause(ctx))
+	if len(state.responseBody) > 0 {
+		s.flushPartialUsage(state)
+	}
+	return status.FromContextError(ctx.Err()).Err()
+}
+
+// accumulateResponse adds a response body chunk to the body buffered for
+// parsing. A body that outgrows its model's limit or the buffer budget is
+// dropped, and passes through with
+// its usage unparsed.
+func (s *server) accumulateResponse(state *streamState, chunk []byte) {
+	if state.responseOverflow != "" {
+		return
+	}
+	if state.responseLimit > 0 && int64(len(state.responseBody)+len(chunk)) > state.responseLimit {
+		s.overflowResponse(state, "model")
+		return
+	}
+	// reserved chunk by chunk, so one large response can't take more than
+	// the whole budget
+	if !s.buffers.reserve(len(chunk)) {
+		s.overflowResponse(state, "budget")
+		return
+	}
+	state.responseBody = append(state.responseBody, chunk...)
+	state.responseBytes += len(chunk)
+}
+
+// overflowResponse drops a response body that outgrew limit.
+func (s *server) overflowResponse(state *streamState, limit string) {
+	processLog.Warnf("Response body for model %q outgrew the %s buffer limit, passing it through without parsing usage", state.model, limit)
+	s.metrics.responseOverflows.WithLabelValues(limit).Inc()
+	state.responseOverflow = limit
+	state.dropResponseBody()
+}
+
+// flushPartialUsage records whatever usage can be parsed from an incomplete
+// response body, for streams that are being abandoned, and reports whether
+// it did. Usage already recorded for the response is not recorded again.
+func (s *server) flushPartialUsage(state *streamState) bool {
+	if state.usageRecorded || state.responseOverflow != "" {
+		return false
+	}
+	usage, err := s.parseResponseUsage(state)
 	if err != nil {
-		log.Fatalf("[Main] Failed to listen: %v", err)
+		parserLog.Warnf("No usage in partial response body (%d bytes): %v", len(state.responseBody), err)
+		return false
+	}
+	parserLog.Infof("Recording usage from partial response body: %+v", *usage)
+	s.recordUsage(state, usage)
+	return true
+}
+
+// recordIdleUsage records usage from a response whose body frames stopped
+// arriving without EndOfStream, and reports whether it did. Only usage the
+// upstream reported counts: a stream that merely paused mid-generation has
+// none yet, and isn't counted or logged as a parse failure, nor estimated.
+func (s *server) recordIdleUsage(state *streamState) bool {
+	if state.usageRecorded {
+		return false
+	}
+	parser, _ := parserFor(state.responseContentType)
+	if s.parsers != nil && !slices.Contains(s.parsers, parser.Name) {
+		return false
+	}
+	if _, err := parser.parse(state.responseBody); err != nil {
+		processLog.Debugf("No response body frame for %s and no usage yet: %v", s.responseIdleTimeout, err)
+		return false
 	}
-	s := grpc.NewServer()
-	extProcPb.RegisterExternalProcessorServer(s, &server{})
+	processLog.Warnf("No response body frame for %s and no EndOfStream, treating response as ended", s.responseIdleTimeout)
+	return s.flushPartialUsage(state)
+}
+
+// usageEvent builds the event recorded to sinks for a completed request.
+func (s *server) usageEvent(state *streamState, usage *tokenUsage) usageEvent {
+	quote, priced := s.pricing.cost(state.tenant, state.model, state.endpoint, usage)
+	ev := usageEvent{
+		Timestamp:     time.Now(),
+		Environment:   s.environment,
+		Model:         state.reportedModel,
+		Provider:      state.providerName(),
+		Tenant:        state.tenant,
+		RequestID:     state.requestID,
+		ProcessingID:  state.processingID,
+		tokenUsage:    *usage,
+		CostUSD:       quote.USD,
+		CostEstimated: quote.Estimated,
+		priced:        priced,
+		costTiers:     quote.TierUSD,
+
+		UpstreamServiceTimeMS: state.upstreamServiceTime,
+	}
+	if rate, ok := s.credits[state.model]; ok {
+		ev.Credits, ev.credited = rate.credits(usage), true
+	}
+	return ev
+}
+
+// responseBodyHeaders builds a ResponseBody reply that passes the body
+// through and sets headers, leaving out the header mutation when there are
+// none.
+func responseBodyHeaders(headers []*configPb.HeaderValueOption) *extProcPb.ProcessingResponse {
+	bodyResp := &extProcPb.BodyResponse{}
+	if len(headers) > 0 {
+		bodyResp.Response = &extProcPb.CommonResponse{
+			HeaderMutation: &extProcPb.HeaderMutation{SetHeaders: headers},
+		}
+	}
+	return &extProcPb.ProcessingResponse{
+		Response: &extProcPb.ProcessingResponse_ResponseBody{
+			ResponseBody: bodyResp,
+		},
+	}
+}
+
+// immediateResponse builds a response that ends the stream and replies to the
+// client directly with the given status, body and headers.
+func immediateResponse(code typePb.StatusCode, body string, headers ...*configPb.HeaderValueOption) *extProcPb.ProcessingResponse {
+	ir := &extProcPb.ImmediateResponse{
+		Status: &typePb.HttpStatus{Code: code},
+		Body:   []byte(body),
+	}
+	if len(headers) > 0 {
+		ir.Headers = &extProcPb.HeaderMutation{SetHeaders: headers}
+	}
+	return &extProcPb.ProcessingResponse{
+		Response: &extProcPb.ProcessingResponse_ImmediateResponse{
+			ImmediateResponse: ir,
+		},
+	}
+}
+
+// newServer builds the ext_proc server from a validated config.
+func newServer(cfg *config, environment string, m *metrics, sinks *multiSink, maintenance *maintenanceMode) *server {
+	s := &server{
+		environment:     environment,
+		requestIDHeader: cfg.RequestIDHeader,
+		tenantHeader:    cfg.TenantHeader,
+		pricing:         pricing{base: cfg.Pricing, tenants: cfg.TenantPricing},
+		retryCosts:      newRetryCostStore(time.Duration(cfg.RetryCostWindow)),
+		credits:         cfg.Credits,
+		tenantModels:    cfg.TenantModels,
+		sampling:        cfg.Sampling,
+		buffering:       cfg.AdaptiveBuffering,
+		passthrough:     cfg.Passthrough,
+		modelPrefix:     cfg.ModelPrefix,
+		modelAliases:    cfg.ModelAliases,
+
+		preferOriginalPath: cfg.PreferOriginalPath,
+
+		metadataNamespace: cfg.DynamicMetadataNamespace,
+		traceIDHeaders:    cfg.TraceIDHeaders,
+		traceExemplars:    cfg.TraceExemplars,
+		receivedAtFormat:  cfg.RequestReceivedAt,
+		staticHeaders:     staticHeaderOptions(cfg.StaticResponseHeaders),
+		redactor:          newRedactor(cfg.LogRedactFields),
+		requestSchemas:    cfg.RequestSchemas,
+
+		contextWindows:       cfg.ContextWindows,
+		contextWarnThreshold: cfg.ContextWarnThreshold,
+		bufferRequestBody:    cfg.BufferRequestBody,
+		injectUsage:          cfg.InjectUsageIntoBody,
+		usageBaggage:         cfg.UsageBaggage,
+		detectRefusals:       cfg.DetectRefusals,
+		estimateDelta:        cfg.EstimateDelta,
+		warningHeader:        cfg.ProcessingWarningHeader,
+		requestHash:          cfg.RequestHash,
+		classifyErrors:       cfg.ClassifyErrors,
+		maxCostHeader:        cfg.EstimateMaxCost,
+		providerHeader:       cfg.ProviderHeader,
+		formatHeader:         cfg.ResponseFormatHeader,
+		parsers:              cfg.Parsers,
+		rejectUnparsed:       cfg.ParseFailureMode == "reject",
+		processingIDFormat:   cfg.ProcessingID,
+		zeroUsage:            cfg.ZeroUsage,
+		decompressLimit:      cfg.RequestDecompressionLimitBytes,
+
+		maintenance: maintenance,
+
+		metrics:     m,
+		sinks:       sinks,
+		limiter:     newConcurrencyLimiter(cfg.ModelConcurrency, m.inFlight),
+		rateLimiter: newRateLimiter(cfg.RateLimit),
+		buffers:     newBufferBudget(cfg.BufferMemoryLimitBytes, m.bufferedBytes),
+
+		shadowParser: cfg.ShadowParser,
+
+		responseTimeout:     time.Duration(cfg.ResponseTimeout),
+		responseIdleTimeout: time.Duration(cfg.ResponseIdleTimeout),
+		processingBudget:    time.Duration(cfg.ProcessingBudget),
+		budgetFastReturn:    cfg.ProcessingBudgetFastReturn,
+
+		strictTotalTokens: cfg.StrictTotalTokens,
+		maxTokenCount:     cfg.MaxTokenCount,
+		clampTokenCounts:  cfg.ClampTokenCounts,
+	}
+	if cfg.StderrSummary {
+		s.summary = newSummaryWriter(os.Stderr)
+	}
+	s.throughput = newThroughputAverages(cfg.AvgTokensPerSecond)
+	tok := cfg.Tokenizer.get()
+	if cfg.EstimateDelta || cfg.EstimateMaxCost || cfg.StreamUsageEstimate.on() {
+		s.requestTokenizer = tok
+	}
+	s.streamTokenizer = cfg.StreamUsageEstimate.tokenizer(tok)
+	if cfg.AccountingMetadataFlag != "" {
+		flag, _ := parseMetadataFlag(cfg.AccountingMetadataFlag)
+		s.accountingFlag = &flag
+	}
+	return s
+}
+
+// newGRPCServer registers srv and the health service on a gRPC server,
+// recovering panicking calls and requiring authToken on every call when it is
+// set. Keeping this out of main
+// lets the full wiring be exercised over an in-memory listener.
+func newGRPCServer(srv *server, authToken string) *grpc.Server {
+	// panic recovery comes first so it also covers the interceptors after it
+	recovery := &panicRecovery{panics: srv.metrics.panics}
+	unary := []grpc.UnaryServerInterceptor{recovery.unaryInterceptor}
+	stream := []grpc.StreamServerInterceptor{recovery.streamInterceptor}
+	if authToken != "" {
+		auth := &tokenAuth{token: []byte(authToken)}
+		unary = append(unary, auth.unaryInterceptor)
+		stream = append(stream, auth.streamInterceptor)
+		mainLog.Infof("Requiring authorization token on gRPC calls")
+	}
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(unary...), grpc.ChainStreamInterceptor(stream...))
+	extProcPb.RegisterExternalProcessorServer(s, srv)
 	healthPb.RegisterHealthServer(s, &healthServer{})
-	log.Println("[Main] Starting gRPC server on port :50051")
+	return s
+}
+
+func main() {
+	environment := flag.String("environment", os.Getenv("ENV"), "deployment environment (e.g. prod, staging) attached to metrics and logs; defaults to $ENV")
+	metricsAddr := flag.String("metrics-addr", ":9090", "address for the Prometheus metrics listener")
+	requireMetrics := flag.Bool("require-metrics", false, "exit if the metrics listener cannot be started")
+	serveRestarts := flag.Int("serve-restarts", 3, "times to re-bind and re-serve the gRPC server after an unexpected serve error")
+	configPath := flag.String("config", "", "path to an optional YAML or JSON config file")
+	authToken := flag.String("auth-token", os.Getenv("AUTH_TOKEN"), "shared secret required in the authorization metadata of every gRPC call; defaults to $AUTH_TOKEN, disabled when empty")
+	adminToken := flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "bearer token required to change /maintenance on the metrics listener; defaults to $ADMIN_TOKEN, read-only when empty")
+	checkConfig := flag.Bool("check-config", false, "validate the config and exit without starting the server")
+	usageStdout := flag.Bool("usage-stdout", false, "write usage events to stdout as NDJSON")
+	grpcGzip := flag.Bool("grpc-gzip", false, "accept and respond with gzip-compressed gRPC messages")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "how long to let in-flight streams finish on SIGTERM before cancelling them")
+	reusePort := flag.Bool("reuseport", false, "bind the gRPC port with SO_REUSEPORT so overlapping instances can share it during restarts")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
+	if err == nil {
+		err = cfg.checkStdout(*usageStdout)
+	}
+	if *checkConfig {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "config is invalid:\n%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("config is valid")
+		os.Exit(0)
+	}
+	if err != nil {
+		mainLog.Fatalf("Failed to load config: %v", err)
+	}
+	setLogLevels(cfg.LogLevels)
+	setHeaderAppendAction(cfg.HeaderAppendAction)
+	maxHeaderValueLength = cfg.MaxHeaderValueLength
+	if cfg.ParserSelfTest != "" {
+		errs := selfTestParsers()
+		for _, err := range errs {
+			mainLog.Warnf("Parser self-test failed: %v", err)
+		}
+		if len(errs) > 0 && cfg.ParserSelfTest == selfTestFail {
+			mainLog.Fatalf("Parser self-test failed for %d parser(s), refusing to start", len(errs))
+		}
+		if len(errs) == 0 {
+			mainLog.Infof("Parser self-test passed for %d parsers", len(parsers))
+		}
+	}
+
+	if *environment != "" {
+		log.SetPrefix("env=" + *environment + " ")
+	}
+
+	reg := prometheus.NewRegistry()
+	warnHighCardinalityHeaders(cfg.MetricLabelHeaders)
+	m := newMetrics(reg, *environment, cfg.MetricLabelHeaders, cfg.MaxModelLabels)
+	if cfg.MetricsFlushInterval > 0 {
+		m.batchTokens(time.Duration(cfg.MetricsFlushInterval))
+	}
+	// the metrics listener is auxiliary: failing to bind it shouldn't take down
+	// the data path unless -require-metrics says otherwise
+	maintenance := &maintenanceMode{RetryAfterSeconds: defaultRetryAfter, adminToken: []byte(*adminToken)}
+	mux := http.NewServeMux()
+	// exemplars, which carry processing and trace ids, are only exposed in
+	// the OpenMetrics format
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{EnableOpenMetrics: cfg.ProcessingID != "" || cfg.TraceExemplars}))
+	mux.Handle("/maintenance", maintenance)
+	mux.HandleFunc("/providers", serveProviders)
+	if metricsLis, err := net.Listen("tcp", *metricsAddr); err != nil {
+		if *requireMetrics {
+			mainLog.Fatalf("Failed to listen for metrics: %v", err)
+		}
+		mainLog.Warnf("failed to listen for metrics on %s, continuing without metrics: %v", *metricsAddr, err)
+	} else {
+		go func() {
+			mainLog.Infof("Starting metrics server on %s", *metricsAddr)
+			if err := http.Serve(metricsLis, mux); err != nil {
+				mainLog.Errorf("Metrics server stopped: %v", err)
+			}
+		}()
+	}
 
+	sinks, err := newSinks(cfg, m)
+	if err != nil {
+		mainLog.Fatalf("Failed to start usage sinks: %v", err)
+	}
+	if *usageStdout {
+		sinks.add("stdout", newStdoutSink(os.Stdout))
+	}
+
+	const addr = ":50051"
+	var lc net.ListenConfig
+	if *reusePort {
+		lc.Control = setReusePort
+	}
+	listen := func() (net.Listener, error) {
+		lis, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return &grpcOnlyListener{Listener: lis, rejected: m.nonGRPCConns}, nil
+	}
+	lis, err := listen()
+	if err != nil {
+		mainLog.Fatalf("Failed to listen: %v", err)
+	}
+	if *grpcGzip {
+		enableGzip()
+		mainLog.Infof("Enabled gzip compression on gRPC calls")
+	}
+	s := newGRPCServer(newServer(cfg, *environment, m, sinks, maintenance), *authToken)
+	mainLog.Infof("Starting gRPC server on port :50051")
+
+	var stopping atomic.Bool
+	stopped := make(chan struct{})
 	gracefulStop := make(chan os.Signal, 1)
 	signal.Notify(gracefulStop, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
 		<-gracefulStop
-		log.Println("[Main] Received shutdown signal, exiting after 1 second")
-		time.Sleep(1 * time.Second)
-		os.Exit(0)
+		stopping.Store(true)
+		mainLog.Infof("Received shutdown signal, draining in-flight streams for up to %s", *shutdownTimeout)
+		// stop taking streams and let open ones finish first, so their usage
+		// is recorded before metrics are flushed and the sinks closed
+		stopGracefully(s, *shutdownTimeout)
+		// flush batched metrics so a final scrape sees them
+		m.flush()
+		if err := sinks.Close(); err != nil {
+			mainLog.Errorf("Failed to close usage sinks: %v", err)
+		}
+		close(stopped)
 	}()
 
-	if err := s.Serve(lis); err != nil {
-		log.Fatalf("[Main] Failed to serve: %v", err)
+	if err := serveWithRestarts(s, lis, listen, *serveRestarts, &stopping); err != nil {
+		mainLog.Fatalf("Failed to serve: %v", err)
 	}
+	<-stopped
 }
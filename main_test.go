@@ -0,0 +1,707 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	configPb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	filterPb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typePb "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// testConfig loads a config from YAML, validated and defaulted as a -config
+// file would be.
+func testConfig(t *testing.T, yaml string) *config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// newTestServer builds a server for cfg with its own metrics registry.
+func newTestServer(t *testing.T, cfg *config) *server {
+	t.Helper()
+	m := newMetrics(prometheus.NewRegistry(), "", cfg.MetricLabelHeaders, cfg.MaxModelLabels)
+	sinks, err := newSinks(cfg, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sinks.Close() })
+	return newServer(cfg, "", m, sinks, &maintenanceMode{})
+}
+
+// responseState is a stream that has received a complete response.
+func responseState(status, contentType string, body []byte) *streamState {
+	state := newStreamState()
+	state.resetResponse(status, contentType)
+	state.responseBody = body
+	return state
+}
+
+// fakeStream feeds frames to Process and collects its responses, ending the
+// stream once the frames run out.
+type fakeStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	frames []*extProcPb.ProcessingRequest
+	sent   []*extProcPb.ProcessingResponse
+}
+
+func (f *fakeStream) Context() context.Context { return f.ctx }
+
+func (f *fakeStream) Recv() (*extProcPb.ProcessingRequest, error) {
+	if len(f.frames) == 0 {
+		return nil, io.EOF
+	}
+	req := f.frames[0]
+	f.frames = f.frames[1:]
+	return req, nil
+}
+
+func (f *fakeStream) Send(resp *extProcPb.ProcessingResponse) error {
+	f.sent = append(f.sent, resp)
+	return nil
+}
+
+// process runs frames through one Process stream on s and returns what it
+// sent back.
+func process(t *testing.T, s *server, frames ...*extProcPb.ProcessingRequest) []*extProcPb.ProcessingResponse {
+	t.Helper()
+	stream := &fakeStream{ctx: context.Background(), frames: frames}
+	if err := s.Process(stream); err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	return stream.sent
+}
+
+func headerMap(kv ...string) *configPb.HeaderMap {
+	m := &configPb.HeaderMap{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		m.Headers = append(m.Headers, &configPb.HeaderValue{Key: kv[i], RawValue: []byte(kv[i+1])})
+	}
+	return m
+}
+
+func requestHeaders(kv ...string) *extProcPb.ProcessingRequest {
+	return &extProcPb.ProcessingRequest{Request: &extProcPb.ProcessingRequest_RequestHeaders{
+		RequestHeaders: &extProcPb.HttpHeaders{Headers: headerMap(kv...)},
+	}}
+}
+
+func requestBody(body string) *extProcPb.ProcessingRequest {
+	return &extProcPb.ProcessingRequest{Request: &extProcPb.ProcessingRequest_RequestBody{
+		RequestBody: &extProcPb.HttpBody{Body: []byte(body), EndOfStream: true},
+	}}
+}
+
+func responseHeaders(kv ...string) *extProcPb.ProcessingRequest {
+	return &extProcPb.ProcessingRequest{Request: &extProcPb.ProcessingRequest_ResponseHeaders{
+		ResponseHeaders: &extProcPb.HttpHeaders{Headers: headerMap(kv...)},
+	}}
+}
+
+func responseBody(body string, endOfStream bool) *extProcPb.ProcessingRequest {
+	return &extProcPb.ProcessingRequest{Request: &extProcPb.ProcessingRequest_ResponseBody{
+		ResponseBody: &extProcPb.HttpBody{Body: []byte(body), EndOfStream: endOfStream},
+	}}
+}
+
+// jsonExchange is the frames of a buffered JSON request and response.
+func jsonExchange(path, request, response string) []*extProcPb.ProcessingRequest {
+	return []*extProcPb.ProcessingRequest{
+		requestHeaders(":path", path),
+		requestBody(request),
+		responseHeaders(":status", "200", "content-type", "application/json"),
+		responseBody(response, true),
+	}
+}
+
+// setHeaders returns the headers a response sets, by name.
+func setHeaders(resp *extProcPb.ProcessingResponse) map[string]string {
+	var common *extProcPb.CommonResponse
+	switch r := resp.Response.(type) {
+	case *extProcPb.ProcessingResponse_RequestHeaders:
+		common = r.RequestHeaders.GetResponse()
+	case *extProcPb.ProcessingResponse_RequestBody:
+		common = r.RequestBody.GetResponse()
+	case *extProcPb.ProcessingResponse_ResponseHeaders:
+		common = r.ResponseHeaders.GetResponse()
+	case *extProcPb.ProcessingResponse_ResponseBody:
+		common = r.ResponseBody.GetResponse()
+	}
+	headers := map[string]string{}
+	for _, h := range common.GetHeaderMutation().GetSetHeaders() {
+		headers[h.GetHeader().GetKey()] = string(h.GetHeader().GetRawValue())
+	}
+	return headers
+}
+
+// histogramSamples returns the sample count and sum h has observed.
+func histogramSamples(t *testing.T, h prometheus.Histogram) (uint64, float64) {
+	t.Helper()
+	var m dto.Metric
+	if err := h.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+// readFixture returns a file from testdata.
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestEmbeddingsResponse(t *testing.T) {
+	s := newTestServer(t, testConfig(t, `
+pricing:
+  text-embedding-3-small:
+    prompt: 1.00
+    completion: 1.00
+    embedding: 0.02
+`))
+	sent := process(t, s, jsonExchange("/v1/embeddings",
+		`{"model":"text-embedding-3-small","input":"The food was delicious"}`,
+		string(readFixture(t, "embeddings.json")))...)
+	headers := setHeaders(sent[len(sent)-1])
+	if headers[headerPromptTokens] != "8" || headers[headerTotalTokens] != "8" {
+		t.Errorf("got prompt %q and total %q tokens, want 8 and 8", headers[headerPromptTokens], headers[headerTotalTokens])
+	}
+	if v, ok := headers[headerCompletionTokens]; ok {
+		t.Errorf("embeddings response set %s: %q", headerCompletionTokens, v)
+	}
+	if got, want := headers[headerCostUSD], "0.00000016"; got != want {
+		t.Errorf("cost = %q, want %q at the embedding rate", got, want)
+	}
+	if got := testutil.ToFloat64(s.metrics.tokens.WithLabelValues("prompt", endpointEmbeddings, "first")); got != 8 {
+		t.Errorf("tokens_total{type=prompt,endpoint=embeddings} = %v, want 8", got)
+	}
+}
+
+func TestDetectEndpoint(t *testing.T) {
+	embeddings := readFixture(t, "embeddings.json")
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		body        []byte
+		want        string
+	}{
+		{name: "embeddings path", path: "/v1/embeddings?api-version=1", contentType: "application/json", body: []byte(`{}`), want: endpointEmbeddings},
+		{name: "embeddings body", path: "/proxy", contentType: "application/json", body: embeddings, want: endpointEmbeddings},
+		{name: "chat completion", path: "/v1/chat/completions", contentType: "application/json", body: readFixture(t, "chat_no_total.json"), want: endpointCompletions},
+		{name: "event stream", path: "/proxy", contentType: "text/event-stream", body: embeddings, want: endpointCompletions},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectEndpoint(tt.path, tt.contentType, tt.body); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDuplicateResponseHeaders(t *testing.T) {
+	s := newTestServer(t, testConfig(t, ""))
+	sent := process(t, s,
+		requestHeaders(":path", "/v1/chat/completions"),
+		requestBody(`{"model":"gpt-4o"}`),
+		responseHeaders(":status", "503", "content-type", "application/json"),
+		responseHeaders(":status", "200", "content-type", "application/json"),
+		responseHeaders(":status", "200", "content-type", "application/json"),
+		responseBody(string(readFixture(t, "chat_no_total.json")), true),
+	)
+	if len(sent) != 6 {
+		t.Fatalf("got %d responses, want 6", len(sent))
+	}
+	if sent[2].GetModeOverride() == nil {
+		t.Error("first ResponseHeaders has no ModeOverride")
+	}
+	for _, resp := range sent[3:5] {
+		if resp.GetModeOverride() != nil {
+			t.Errorf("duplicate ResponseHeaders set a ModeOverride: %v", resp.GetModeOverride())
+		}
+	}
+	// the retried 200 replaced the 503, so the body is accounted
+	if got := setHeaders(sent[5])[headerTotalTokens]; got != "17" {
+		t.Errorf("total tokens = %q, want 17", got)
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	s := newTestServer(t, testConfig(t, ""))
+	sent := process(t, s,
+		&extProcPb.ProcessingRequest{Request: &extProcPb.ProcessingRequest_RequestTrailers{
+			RequestTrailers: &extProcPb.HttpTrailers{},
+		}},
+		&extProcPb.ProcessingRequest{Request: &extProcPb.ProcessingRequest_ResponseTrailers{
+			ResponseTrailers: &extProcPb.HttpTrailers{},
+		}},
+	)
+	if len(sent) != 2 {
+		t.Fatalf("got %d responses, want 2", len(sent))
+	}
+	if sent[0].GetRequestTrailers() == nil {
+		t.Errorf("request trailers answered with %T", sent[0].Response)
+	}
+	if sent[1].GetResponseTrailers() == nil {
+		t.Errorf("response trailers answered with %T", sent[1].Response)
+	}
+}
+
+func TestMultiChoiceResponse(t *testing.T) {
+	s := newTestServer(t, testConfig(t, ""))
+	sent := process(t, s, jsonExchange("/v1/chat/completions",
+		`{"model":"gpt-4o","n":3}`,
+		string(readFixture(t, "chat_n3.json")))...)
+	if got := setHeaders(sent[len(sent)-1])[headerChoicesCount]; got != "3" {
+		t.Errorf("%s = %q, want 3", headerChoicesCount, got)
+	}
+	if count, sum := histogramSamples(t, s.metrics.choices); count != 1 || sum != 3 {
+		t.Errorf("response_choices count %d sum %v, want 1 and 3", count, sum)
+	}
+	if count, sum := histogramSamples(t, s.metrics.choiceTokens); count != 3 || sum != 9 {
+		t.Errorf("choice_completion_tokens count %d sum %v, want 3 and 9", count, sum)
+	}
+}
+
+func TestRequestBodyCountsAgainstBufferBudget(t *testing.T) {
+	s := newTestServer(t, testConfig(t, `
+buffer_request_body: true
+buffer_memory_limit_bytes: 16
+`))
+	body := `{"model":"gpt-4o","messages":[]}`
+	stream := &fakeStream{ctx: context.Background(), frames: []*extProcPb.ProcessingRequest{
+		requestHeaders(":path", "/v1/chat/completions"),
+		requestBody(body),
+	}}
+	// the RequestBody response is sent once the body is charged; hold the
+	// stream there so the budget can be read
+	held, next := make(chan struct{}), make(chan struct{})
+	hooked := &sendHook{fakeStream: stream, send: func(resp *extProcPb.ProcessingResponse) {
+		if resp.GetRequestBody() != nil {
+			close(held)
+			<-next
+		}
+	}}
+	done := make(chan error)
+	go func() { done <- s.Process(hooked) }()
+	<-held
+	if got, want := s.buffers.used.Load(), int64(len(body)); got != want {
+		t.Errorf("budget used = %d, want %d", got, want)
+	}
+	if !s.buffers.exhausted() {
+		t.Error("budget not exhausted by a request body over the limit")
+	}
+	close(next)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := s.buffers.used.Load(); got != 0 {
+		t.Errorf("budget used = %d after the stream ended, want 0", got)
+	}
+}
+
+// sendHook is a fakeStream that calls send with each response before
+// collecting it.
+type sendHook struct {
+	*fakeStream
+	send func(*extProcPb.ProcessingResponse)
+}
+
+func (h *sendHook) Send(resp *extProcPb.ProcessingResponse) error {
+	h.send(resp)
+	return h.fakeStream.Send(resp)
+}
+
+func TestModelPrefixReportedEverywhere(t *testing.T) {
+	s := newTestServer(t, testConfig(t, `
+model_prefix:
+  hosts:
+    api.openai.com: openai
+pricing:
+  gpt-4o:
+    prompt: 2.50
+    completion: 10.00
+`))
+	sent := process(t, s,
+		requestHeaders(":path", "/v1/chat/completions", ":authority", "api.openai.com:443"),
+		requestBody(`{"model":"gpt-4o"}`),
+		responseHeaders(":status", "200", "content-type", "application/json", "x-envoy-upstream-service-time", "120"),
+		responseBody(string(readFixture(t, "chat_no_total.json")), true),
+	)
+	headers := setHeaders(sent[len(sent)-1])
+	if got := headers[headerModel]; got != "openai/gpt-4o" {
+		t.Errorf("%s = %q, want openai/gpt-4o", headerModel, got)
+	}
+	// pricing still matches the bare model
+	if got := headers[headerCostUSD]; got != "0.00008" {
+		t.Errorf("cost = %q, want 0.00008", got)
+	}
+	if n := testutil.CollectAndCount(s.metrics.upstreamServiceTime); n != 1 {
+		t.Fatalf("upstream_service_time has %d series, want 1", n)
+	}
+	if count, _ := histogramSamples(t, s.metrics.upstreamServiceTime.WithLabelValues("openai/gpt-4o").(prometheus.Histogram)); count != 1 {
+		t.Errorf("upstream_service_time{model=openai/gpt-4o} has %d samples, want 1", count)
+	}
+	if count, _ := histogramSamples(t, s.metrics.requestTokens.WithLabelValues("total", "openai", "openai/gpt-4o").(prometheus.Histogram)); count != 1 {
+		t.Errorf("request_tokens{model=openai/gpt-4o} has %d samples, want 1", count)
+	}
+}
+
+func TestModelPrefixDetectedProvider(t *testing.T) {
+	s := newTestServer(t, testConfig(t, "model_prefix: {}"))
+	tests := []struct {
+		fixture string
+		model   string
+		want    string
+	}{
+		{fixture: "chat_no_total.json", model: "gpt-4o", want: "openai/gpt-4o"},
+		{fixture: "anthropic_cached.json", model: "claude-sonnet-4", want: "anthropic/claude-sonnet-4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			sent := process(t, s, jsonExchange("/v1/chat/completions", `{"model":"`+tt.model+`"}`, string(readFixture(t, tt.fixture)))...)
+			if got := setHeaders(sent[len(sent)-1])[headerModel]; got != tt.want {
+				t.Errorf("%s = %q, want %q", headerModel, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheHeaders(t *testing.T) {
+	s := newTestServer(t, testConfig(t, ""))
+	tests := []struct {
+		fixture string
+		want    map[string]string
+	}{
+		{fixture: "openai_cached.json", want: map[string]string{headerCacheReadTokens: "1920", headerCacheHit: "true"}},
+		{fixture: "anthropic_cached.json", want: map[string]string{headerCacheReadTokens: "1800", headerCacheWriteTokens: "188", headerCacheHit: "true", headerTotalTokens: "2402"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			sent := process(t, s, jsonExchange("/v1/messages", `{"model":"m"}`, string(readFixture(t, tt.fixture)))...)
+			headers := setHeaders(sent[len(sent)-1])
+			for name, v := range tt.want {
+				if headers[name] != v {
+					t.Errorf("%s = %q, want %q", name, headers[name], v)
+				}
+			}
+		})
+	}
+}
+
+func TestReasoningTokensHeader(t *testing.T) {
+	s := newTestServer(t, testConfig(t, ""))
+	sent := process(t, s, jsonExchange("/v1/chat/completions", `{"model":"o1"}`, string(readFixture(t, "o1_reasoning.json")))...)
+	headers := setHeaders(sent[len(sent)-1])
+	if got, want := headers[headerReasoningTokens], "1280"; got != want {
+		t.Errorf("%s = %q, want %q", headerReasoningTokens, got, want)
+	}
+	if got, want := headers[headerCompletionTokens], "1353"; got != want {
+		t.Errorf("%s = %q, want %q", headerCompletionTokens, got, want)
+	}
+}
+
+func TestLargeTokenCountHeaders(t *testing.T) {
+	s := newTestServer(t, testConfig(t, "max_token_count: 10000000000"))
+	sent := process(t, s, jsonExchange("/v1/chat/completions", `{"model":"gpt-4o"}`, string(readFixture(t, "large_counts.json")))...)
+	headers := setHeaders(sent[len(sent)-1])
+	want := map[string]string{
+		headerPromptTokens:     "5000000000",
+		headerCompletionTokens: "2500000001",
+		headerTotalTokens:      "7500000001",
+	}
+	for name, v := range want {
+		if headers[name] != v {
+			t.Errorf("%s = %q, want %q", name, headers[name], v)
+		}
+	}
+}
+
+func TestMultiChunkResponseBody(t *testing.T) {
+	s := newTestServer(t, testConfig(t, "inject_usage_into_body: true"))
+	// usage wrapped in a Responses API event leaves the body without a
+	// top-level "usage" object, so one is injected when it arrives in one
+	// frame
+	body := `{"type":"response.completed","response":{"id":"resp_1","output":[],"usage":{"input_tokens":12,"output_tokens":5,"total_tokens":17}}}`
+	tests := []struct {
+		name   string
+		chunks []string
+	}{
+		{name: "one chunk", chunks: []string{body}},
+		{name: "two chunks", chunks: []string{body[:len(body)/2], body[len(body)/2:]}},
+		{name: "three chunks", chunks: []string{body[:len(body)/3], body[len(body)/3 : 2*len(body)/3], body[2*len(body)/3:]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames := []*extProcPb.ProcessingRequest{
+				requestHeaders(":path", "/v1/chat/completions"),
+				requestBody(`{"model":"gpt-4o"}`),
+				responseHeaders(":status", "200", "content-type", "application/json"),
+			}
+			for i, chunk := range tt.chunks {
+				frames = append(frames, responseBody(chunk, i == len(tt.chunks)-1))
+			}
+			sent := process(t, s, frames...)
+			bodies := sent[3:]
+			for i, resp := range bodies[:len(bodies)-1] {
+				if common := resp.GetResponseBody().GetResponse(); common != nil {
+					t.Errorf("intermediate frame %d modified: %v", i, common)
+				}
+			}
+			last := bodies[len(bodies)-1]
+			if got := setHeaders(last)[headerTotalTokens]; got != "17" {
+				t.Errorf("total tokens = %q, want 17", got)
+			}
+			injected := last.GetResponseBody().GetResponse().GetBodyMutation() != nil
+			if want := len(tt.chunks) == 1; injected != want {
+				t.Errorf("usage injected = %v, want %v", injected, want)
+			}
+		})
+	}
+}
+
+func TestStreamedResponseBody(t *testing.T) {
+	s := newTestServer(t, testConfig(t, `
+inject_usage_into_body: true
+adaptive_buffering:
+  max_buffered_bytes: 1024
+`))
+	frames := []*extProcPb.ProcessingRequest{
+		requestHeaders(":path", "/v1/chat/completions"),
+		requestBody(`{"model":"gpt-4o","stream":true}`),
+		responseHeaders(":status", "200", "content-type", "text/event-stream"),
+	}
+	// one frame per SSE event, as Envoy streams them
+	events := strings.SplitAfter(string(readFixture(t, "chat_n3.sse")), "\n\n")
+	for i, event := range events {
+		frames = append(frames, responseBody(event, i == len(events)-1))
+	}
+	sent := process(t, s, frames...)
+
+	if got := sent[2].GetModeOverride().GetResponseBodyMode(); got != filterPb.ProcessingMode_STREAMED {
+		t.Errorf("response body mode = %v, want STREAMED", got)
+	}
+	bodies := sent[3:]
+	for i, resp := range bodies[:len(bodies)-1] {
+		if !proto.Equal(resp.GetResponseBody(), &extProcPb.BodyResponse{}) {
+			t.Errorf("chunk %d got %v, want an empty BodyResponse", i, resp)
+		}
+	}
+	last := bodies[len(bodies)-1].GetResponseBody().GetResponse()
+	if got := setHeaders(bodies[len(bodies)-1])[headerTotalTokens]; got != "18" {
+		t.Errorf("total tokens = %q, want 18", got)
+	}
+	if last.GetBodyMutation() != nil {
+		t.Errorf("streamed body was mutated: %v", last.GetBodyMutation())
+	}
+}
+
+func TestInvalidJSONPassesThrough(t *testing.T) {
+	s := newTestServer(t, testConfig(t, ""))
+	sent := process(t, s, jsonExchange("/v1/chat/completions", `{"model":"gpt-4o"}`, `{"choices": [`)...)
+	last := sent[len(sent)-1].GetResponseBody()
+	if last == nil {
+		t.Fatalf("got %T, want a ResponseBody reply", sent[len(sent)-1].Response)
+	}
+	if common := last.GetResponse(); common.GetHeaderMutation() != nil || common.GetBodyMutation() != nil {
+		t.Errorf("unparseable body was modified: %v", common)
+	}
+}
+
+func TestModeOverride(t *testing.T) {
+	s := newTestServer(t, testConfig(t, ""))
+	sent := process(t, s, jsonExchange("/v1/chat/completions", `{"model":"gpt-4o"}`, string(readFixture(t, "chat_no_total.json")))...)
+	if len(sent) != 4 {
+		t.Fatalf("got %d replies, want 4", len(sent))
+	}
+	tests := []struct {
+		name  string
+		reply *extProcPb.ProcessingResponse
+		want  *filterPb.ProcessingMode
+	}{
+		{
+			name:  "ResponseHeaders sends headers and buffers the body",
+			reply: sent[2],
+			want:  &filterPb.ProcessingMode{ResponseHeaderMode: filterPb.ProcessingMode_SEND, ResponseBodyMode: filterPb.ProcessingMode_BUFFERED},
+		},
+		{name: "no override on RequestHeaders", reply: sent[0]},
+		{name: "no override on RequestBody", reply: sent[1]},
+		{name: "no override on ResponseBody", reply: sent[3]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.reply.GetModeOverride(); !proto.Equal(got, tt.want) {
+				t.Errorf("%T override = %v, want %v", tt.reply.Response, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRejectOnlyUsageEndpoints(t *testing.T) {
+	s := newTestServer(t, testConfig(t, `
+parsers: [json]
+parse_failure_mode: reject
+`))
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		wantReject bool
+	}{
+		{name: "models", path: "/v1/models", body: `{"object":"list","data":[{"id":"gpt-4o","object":"model"}]}`},
+		{name: "health check", path: "/healthz", body: `{"status":"ok"}`},
+		{name: "chat completion", path: "/v1/chat/completions", body: `{"choices":[{"index":0,"message":{"content":"hi"}}]}`, wantReject: true},
+		{name: "completion on a proxy path", path: "/proxy", body: `{"choices":[{"index":0,"message":{"content":"hi"}}]}`, wantReject: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := process(t, s, jsonExchange(tt.path, `{}`, tt.body)...)
+			rejected := sent[len(sent)-1].GetImmediateResponse() != nil
+			if rejected != tt.wantReject {
+				t.Errorf("rejected = %v, want %v", rejected, tt.wantReject)
+			}
+		})
+	}
+}
+
+func TestTenantModels(t *testing.T) {
+	s := newTestServer(t, testConfig(t, `
+tenant_header: x-tenant
+buffer_request_body: true
+tenant_models:
+  acme: [gpt-4o]
+passthrough:
+  paths: ["/static/"]
+`))
+	tests := []struct {
+		name   string
+		frames []*extProcPb.ProcessingRequest
+		denied bool
+	}{
+		{name: "allowed model", frames: []*extProcPb.ProcessingRequest{
+			requestHeaders(":path", "/v1/chat/completions", "x-tenant", "acme"),
+			requestBody(`{"model":"gpt-4o"}`),
+		}},
+		{name: "other model", denied: true, frames: []*extProcPb.ProcessingRequest{
+			requestHeaders(":path", "/v1/chat/completions", "x-tenant", "acme"),
+			requestBody(`{"model":"gpt-4o-mini"}`),
+		}},
+		{name: "passthrough path", denied: true, frames: []*extProcPb.ProcessingRequest{
+			requestHeaders(":path", "/static/chat", "x-tenant", "acme"),
+			requestBody(`{"model":"gpt-4o-mini"}`),
+		}},
+		{name: "unlisted tenant", frames: []*extProcPb.ProcessingRequest{
+			requestHeaders(":path", "/v1/chat/completions", "x-tenant", "other"),
+			requestBody(`{"model":"gpt-4o-mini"}`),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := process(t, s, tt.frames...)
+			// a passthrough reply would have Envoy skip the body, and with it
+			// the model check
+			if got := sent[0].GetModeOverride().GetRequestBodyMode(); got != filterPb.ProcessingMode_BUFFERED {
+				t.Errorf("request body mode = %v, want BUFFERED", got)
+			}
+			status := sent[len(sent)-1].GetImmediateResponse().GetStatus().GetCode()
+			if denied := status == typePb.StatusCode_Forbidden; denied != tt.denied {
+				t.Errorf("denied = %v, want %v (got %v)", denied, tt.denied, sent[len(sent)-1])
+			}
+		})
+	}
+}
+
+func TestTenantModelsRequiresBufferedRequestBody(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := "tenant_header: x-tenant\ntenant_models:\n  acme: [gpt-4o]\n"
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "buffer_request_body") {
+		t.Errorf("got %v, want a buffer_request_body error", err)
+	}
+}
+
+func TestPerModelBufferLimit(t *testing.T) {
+	s := newTestServer(t, testConfig(t, `
+adaptive_buffering:
+  max_buffered_bytes: 1024
+  models:
+    gpt-4.1: 65536
+`))
+	// a chunked body, with no content-length, over the default limit
+	body := `{"id":"chatcmpl-1","choices":[{"message":{"content":"` + strings.Repeat("a", 2048) + `"}}],"usage":{"prompt_tokens":12,"completion_tokens":5,"total_tokens":17}}`
+	for model, wantTotal := range map[string]string{"gpt-4o": "", "gpt-4.1": "17"} {
+		t.Run(model, func(t *testing.T) {
+			sent := process(t, s,
+				requestHeaders(":path", "/v1/chat/completions"),
+				requestBody(`{"model":"`+model+`"}`),
+				responseHeaders(":status", "200", "content-type", "application/json"),
+				responseBody(body[:len(body)/2], false),
+				responseBody(body[len(body)/2:], true),
+			)
+			if got := setHeaders(sent[len(sent)-1])[headerTotalTokens]; got != wantTotal {
+				t.Errorf("total tokens = %q, want %q", got, wantTotal)
+			}
+		})
+	}
+	if got := testutil.ToFloat64(s.metrics.responseOverflows.WithLabelValues("model")); got != 1 {
+		t.Errorf("response_body_overflow_total{limit=model} = %v, want 1", got)
+	}
+}
+
+func TestResponseBodyOverBufferBudget(t *testing.T) {
+	s := newTestServer(t, testConfig(t, "buffer_memory_limit_bytes: 1024"))
+	body := `{"id":"chatcmpl-1","choices":[{"message":{"content":"` + strings.Repeat("a", 2048) + `"}}],"usage":{"prompt_tokens":12,"completion_tokens":5,"total_tokens":17}}`
+	var heldMidway int64
+	stream := &fakeStream{ctx: context.Background(), frames: []*extProcPb.ProcessingRequest{
+		requestHeaders(":path", "/v1/chat/completions"),
+		requestBody(`{"model":"gpt-4o"}`),
+		responseHeaders(":status", "200", "content-type", "application/json"),
+		responseBody(body[:512], false),
+		responseBody(body[512:], true),
+	}}
+	hooked := &sendHook{fakeStream: stream, send: func(resp *extProcPb.ProcessingResponse) {
+		if len(stream.sent) == 3 {
+			heldMidway = s.buffers.used.Load()
+		}
+	}}
+	if err := s.Process(hooked); err != nil {
+		t.Fatal(err)
+	}
+	// the inspected request body is charged too
+	if want := int64(512 + len(`{"model":"gpt-4o"}`)); heldMidway != want {
+		t.Errorf("budget used after the first chunk = %d, want %d", heldMidway, want)
+	}
+	if got := setHeaders(stream.sent[len(stream.sent)-1])[headerTotalTokens]; got != "" {
+		t.Errorf("total tokens = %q for a body over the budget, want none", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.responseOverflows.WithLabelValues("budget")); got != 1 {
+		t.Errorf("response_body_overflow_total{limit=budget} = %v, want 1", got)
+	}
+	if got := s.buffers.used.Load(); got != 0 {
+		t.Errorf("budget used after the stream = %d, want 0", got)
+	}
+}
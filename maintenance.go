@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// defaultRetryAfter is the Retry-After sent during maintenance when none is
+// given.
+const defaultRetryAfter = 300
+
+// maintenanceMode, when enabled, rejects all traffic at the edge with a 503
+// so planned upstream maintenance fails gracefully. Health checks are
+// unaffected.
+type maintenanceMode struct {
+	mu                sync.RWMutex
+	Enabled           bool `json:"enabled"`
+	RetryAfterSeconds int  `json:"retry_after_seconds"`
+
+	// adminToken must be presented as "Authorization: Bearer <token>" to
+	// change the state. When empty the endpoint is read-only, since the
+	// metrics listener it's served on is typically open to scrapers.
+	adminToken []byte
+}
+
+// authorized reports whether r carries the admin token.
+func (m *maintenanceMode) authorized(r *http.Request) bool {
+	if len(m.adminToken) == 0 {
+		return false
+	}
+	v := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(v), m.adminToken) == 1
+}
+
+// state returns whether maintenance is enabled and the Retry-After to send.
+func (m *maintenanceMode) state() (bool, int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.Enabled, m.RetryAfterSeconds
+}
+
+// ServeHTTP reports the maintenance state on GET and sets it on an
+// authorized PUT, e.g.
+//
+//	curl -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" localhost:9090/maintenance -d '{"enabled": true, "retry_after_seconds": 600}'
+func (m *maintenanceMode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if len(m.adminToken) == 0 {
+			http.Error(w, "maintenance mode is read-only without -admin-token", http.StatusForbidden)
+			return
+		}
+		if !m.authorized(r) {
+			http.Error(w, "missing or invalid authorization token", http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Enabled           bool `json:"enabled"`
+			RetryAfterSeconds int  `json:"retry_after_seconds"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.RetryAfterSeconds <= 0 {
+			req.RetryAfterSeconds = defaultRetryAfter
+		}
+		m.mu.Lock()
+		m.Enabled, m.RetryAfterSeconds = req.Enabled, req.RetryAfterSeconds
+		m.mu.Unlock()
+		maintenanceLog.Infof("Maintenance mode set to %v (Retry-After %ds)", req.Enabled, req.RetryAfterSeconds)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
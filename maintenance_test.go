@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaintenanceModePut(t *testing.T) {
+	tests := []struct {
+		name          string
+		adminToken    string
+		authorization string
+		wantStatus    int
+		wantEnabled   bool
+	}{
+		{name: "read-only without admin token", authorization: "Bearer secret", wantStatus: http.StatusForbidden},
+		{name: "missing token", adminToken: "secret", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", adminToken: "secret", authorization: "Bearer nope", wantStatus: http.StatusUnauthorized},
+		{name: "authorized", adminToken: "secret", authorization: "Bearer secret", wantStatus: http.StatusOK, wantEnabled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &maintenanceMode{RetryAfterSeconds: defaultRetryAfter, adminToken: []byte(tt.adminToken)}
+			req := httptest.NewRequest(http.MethodPut, "/maintenance", strings.NewReader(`{"enabled": true}`))
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			m.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if enabled, _ := m.state(); enabled != tt.wantEnabled {
+				t.Errorf("enabled = %v, want %v", enabled, tt.wantEnabled)
+			}
+		})
+	}
+}
+
+func TestMaintenanceModeGet(t *testing.T) {
+	m := &maintenanceMode{Enabled: true, RetryAfterSeconds: 60}
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/maintenance", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if got, want := strings.TrimSpace(rec.Body.String()), `{"enabled":true,"retry_after_seconds":60}`; got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// bufferBudget tracks the request and response body bytes held across all
+// streams, so many concurrent large bodies can't exhaust memory.
+type bufferBudget struct {
+	// limit is the most bytes that may be buffered before new responses stop
+	// being buffered. Zero means unlimited.
+	limit int64
+	used  atomic.Int64
+	gauge prometheus.Gauge
+}
+
+func newBufferBudget(limit int64, gauge prometheus.Gauge) *bufferBudget {
+	return &bufferBudget{limit: limit, gauge: gauge}
+}
+
+// grow accounts for n more buffered bytes.
+func (b *bufferBudget) grow(n int) {
+	b.gauge.Set(float64(b.used.Add(int64(n))))
+}
+
+// reserve accounts for n more buffered bytes if they fit in the budget, and
+// reports whether they did.
+func (b *bufferBudget) reserve(n int) bool {
+	for {
+		used := b.used.Load()
+		if b.limit > 0 && used+int64(n) > b.limit {
+			return false
+		}
+		if b.used.CompareAndSwap(used, used+int64(n)) {
+			b.gauge.Set(float64(used + int64(n)))
+			return true
+		}
+	}
+}
+
+// release returns n bytes to the budget when a stream ends.
+func (b *bufferBudget) release(n int) {
+	b.gauge.Set(float64(b.used.Add(-int64(n))))
+}
+
+// exhausted reports whether the budget is used up.
+func (b *bufferBudget) exhausted() bool {
+	return b.limit > 0 && b.used.Load() >= b.limit
+}
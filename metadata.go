@@ -0,0 +1,30 @@
+package main
+
+import (
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// usageMetadata builds the dynamic metadata written for a completed request so
+// that Envoy access logs can pick it up with %DYNAMIC_METADATA(namespace:key)%
+// without the values being exposed to clients.
+func usageMetadata(namespace string, ev usageEvent) *structpb.Struct {
+	fields := map[string]*structpb.Value{
+		"prompt_tokens":     structpb.NewNumberValue(float64(ev.PromptTokens)),
+		"completion_tokens": structpb.NewNumberValue(float64(ev.CompletionTokens)),
+		"total_tokens":      structpb.NewNumberValue(float64(ev.TotalTokens)),
+	}
+	if ev.Model != "" {
+		fields["model"] = structpb.NewStringValue(ev.Model)
+	}
+	if ev.UpstreamServiceTimeMS > 0 {
+		fields["upstream_service_time_ms"] = structpb.NewNumberValue(float64(ev.UpstreamServiceTimeMS))
+	}
+	if ev.priced {
+		fields["cost_usd"] = structpb.NewNumberValue(ev.CostUSD)
+	}
+	return &structpb.Struct{
+		Fields: map[string]*structpb.Value{
+			namespace: structpb.NewStructValue(&structpb.Struct{Fields: fields}),
+		},
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxFingerprintValues caps distinct system_fingerprint label values. Backend
+// versions change slowly, so this leaves room for many rollouts.
+const maxFingerprintValues = 50
+
+type metrics struct {
+	tokens   *prometheus.CounterVec
+	inFlight *prometheus.GaugeVec
+	// tokenBatch, when set, batches tokens increments.
+	tokenBatch *counterBatch
+
+	completionBreakdown *prometheus.CounterVec
+
+	fingerprints      *prometheus.CounterVec
+	fingerprintCapper *labelCapper
+
+	// headerLabels are the request headers lifted into token metric labels,
+	// with a cardinality capper per label.
+	headerLabels []headerLabel
+	labelCappers []*labelCapper
+
+	// modelCapper bounds the model label, whose values come from untrusted
+	// request bodies.
+	modelCapper    *labelCapper
+	modelOverflows prometheus.Counter
+
+	requestModes   *prometheus.CounterVec
+	rateLimitCalls *prometheus.CounterVec
+
+	serverTimings      *prometheus.HistogramVec
+	serverTimingCapper *labelCapper
+
+	refusals *prometheus.CounterVec
+
+	bufferedBytes prometheus.Gauge
+	bufferSkipped prometheus.Counter
+
+	estimateRatio      prometheus.Histogram
+	contextUtilization prometheus.Histogram
+
+	choices      prometheus.Histogram
+	choiceTokens prometheus.Histogram
+
+	costTiers    *prometheus.CounterVec
+	credits      *prometheus.CounterVec
+	parses       *prometheus.CounterVec
+	shadowParses *prometheus.CounterVec
+	sinkDropped  *prometheus.CounterVec
+	nonGRPCConns prometheus.Counter
+
+	// sinkDeadLetters counts events a sink gave up delivering.
+	sinkDeadLetters *prometheus.CounterVec
+
+	frameDuration  *prometheus.HistogramVec
+	budgetExceeded *prometheus.CounterVec
+
+	providerErrors  *prometheus.CounterVec
+	errorTypeCapper *labelCapper
+
+	panics *prometheus.CounterVec
+
+	upstreamServiceTime *prometheus.HistogramVec
+
+	requestTokens  *prometheus.HistogramVec
+	providerCapper *labelCapper
+
+	zeroUsage       *prometheus.CounterVec
+	responseFormats *prometheus.CounterVec
+	// missingEndOfStream counts responses whose usage was parsed without
+	// EndOfStream, by what ended them (idle|response_timeout).
+	missingEndOfStream *prometheus.CounterVec
+	// modelDenials counts requests rejected for a model not on the tenant's
+	// tenant_models list, by tenant.
+	modelDenials *prometheus.CounterVec
+	// responseOverflows counts response bodies that outgrew a buffer limit,
+	// by limit (model|budget).
+	responseOverflows *prometheus.CounterVec
+}
+
+// newMetrics registers the filter's metrics. When environment is set it is
+// attached as a constant label on every metric so per-env dashboards don't need
+// relabelling in the scrape config. maxModels caps distinct model label values.
+func newMetrics(reg prometheus.Registerer, environment string, headerLabels []headerLabel, maxModels int) *metrics {
+	if environment != "" {
+		reg = prometheus.WrapRegistererWith(prometheus.Labels{"environment": environment}, reg)
+	}
+	tokenLabels := []string{"type", "endpoint", "attempt"}
+	cappers := make([]*labelCapper, len(headerLabels))
+	for i, l := range headerLabels {
+		tokenLabels = append(tokenLabels, l.labelName())
+		cappers[i] = newLabelCapper(l.MaxValues)
+	}
+	m := &metrics{
+		headerLabels: headerLabels,
+		labelCappers: cappers,
+		tokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tokens_total",
+			Help: "Tokens reported in upstream usage, by token type, endpoint (completions|embeddings), Envoy attempt (first|retry) and any configured request header labels.",
+		}, tokenLabels),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "in_flight_requests",
+			Help: "Requests currently in flight for models with a concurrency limit.",
+		}, []string{"model"}),
+		completionBreakdown: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "completion_tokens_breakdown_total",
+			Help: "Completion tokens of reasoning model responses split into visible output and hidden reasoning (kind=visible|reasoning).",
+		}, []string{"kind"}),
+		fingerprints: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "system_fingerprint_responses_total",
+			Help: "Responses by upstream system_fingerprint (backend version). Values beyond the cap are recorded as \"other\".",
+		}, []string{"system_fingerprint"}),
+		fingerprintCapper: newLabelCapper(maxFingerprintValues),
+		modelCapper:       newLabelCapper(maxModels),
+		modelOverflows: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "model_label_overflow_total",
+			Help: "Times a model name was recorded as \"other\" because the distinct model label cap was reached.",
+		}),
+		requestModes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "requests_total",
+			Help: "Requests seen by the filter, by mode (processed|passthrough|disabled).",
+		}, []string{"mode"}),
+		rateLimitCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rate_limit_decisions_total",
+			Help: "Global rate limiter decisions by result (admitted|rejected). rate() of admitted is the current admitted QPS.",
+		}, []string{"result"}),
+		serverTimings: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "upstream_server_timing_ms",
+			Help:    "Durations the upstream reported in its Server-Timing header, by metric name. Names beyond the cap are recorded as \"other\".",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 16),
+		}, []string{"metric"}),
+		serverTimingCapper: newLabelCapper(maxServerTimingMetrics),
+		bufferedBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "buffered_response_bytes",
+			Help: "Request and response body bytes currently buffered across all streams.",
+		}),
+		bufferSkipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "buffer_budget_skipped_total",
+			Help: "Responses whose body was not processed because the buffer memory budget was exhausted.",
+		}),
+		refusals: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "refusals_total",
+			Help: "Responses in which the model declined to answer, by reason (refusal|content_filter).",
+		}, []string{"reason"}),
+		estimateRatio: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "token_estimate_ratio",
+			Help:    "Actual total tokens divided by the estimate made from the request (prompt length plus max_tokens).",
+			Buckets: []float64{0.1, 0.25, 0.5, 0.75, 0.9, 1, 1.1, 1.25, 1.5, 2, 4},
+		}),
+		contextUtilization: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "context_utilization_ratio",
+			Help:    "Prompt tokens as a fraction of the model's configured context window.",
+			Buckets: []float64{0.1, 0.25, 0.5, 0.75, 0.9, 0.95, 1},
+		}),
+		choices: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "response_choices",
+			Help:    "Choices per completions response, e.g. for requests with n>1.",
+			Buckets: []float64{1, 2, 3, 4, 5, 8, 10, 16},
+		}),
+		choiceTokens: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "choice_completion_tokens",
+			Help:    "Completion tokens of each choice of multi-choice responses, from providers that report usage per choice.",
+			Buckets: prometheus.ExponentialBuckets(16, 2, 10),
+		}),
+		costTiers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "cost_usd_by_tier_total",
+			Help: "Cost in USD of models with tiered pricing, by model and pricing tier (0-based).",
+		}, []string{"model", "tier"}),
+		credits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "credits_total",
+			Help: "Usage in billing credits, by model, for models with a credit rate.",
+		}, []string{"model"}),
+		parses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "usage_parse_total",
+			Help: "Response usage parse attempts by provider parser and result (success|failure|disabled).",
+		}, []string{"provider", "result"}),
+		shadowParses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "shadow_parse_total",
+			Help: "Shadow parser comparisons against the default parser, by candidate and result (match|mismatch).",
+		}, []string{"parser", "result"}),
+	}
+	m.sinkDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sink_dropped_events_total",
+		Help: "Usage events dropped because the sink worker pool queue was full, by sink.",
+	}, []string{"sink"})
+	m.sinkDeadLetters = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sink_dead_letters_total",
+		Help: "Usage events a sink gave up delivering after exhausting its retries, by sink.",
+	}, []string{"sink"})
+	m.nonGRPCConns = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "non_grpc_connections_rejected_total",
+		Help: "Connections to the gRPC port rejected because they did not open with the HTTP/2 preface, e.g. HTTP/1.1 probes.",
+	})
+	m.frameDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "frame_processing_seconds",
+		Help:    "Time the filter spent handling each ext_proc frame, by frame type.",
+		Buckets: prometheus.ExponentialBuckets(0.00005, 2, 14),
+	}, []string{"frame"})
+	m.budgetExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "processing_budget_exceeded_total",
+		Help: "Frames whose handling took longer than the configured processing budget, by frame type.",
+	}, []string{"frame"})
+	m.providerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "provider_errors_total",
+		Help: "Upstream error responses by provider (openai|anthropic) and the error type from the body. Types beyond the cap are recorded as \"other\".",
+	}, []string{"provider", "type"})
+	m.errorTypeCapper = newLabelCapper(maxErrorTypes)
+	m.panics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "panics_total",
+		Help: "gRPC calls that panicked and were recovered, by kind (nil_deref|index_out_of_range|runtime|custom).",
+	}, []string{"kind"})
+	m.upstreamServiceTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "upstream_service_time_ms",
+		Help:    "Upstream latency from Envoy's x-envoy-upstream-service-time, by model. For streamed responses this is the time to the response headers.",
+		Buckets: prometheus.ExponentialBuckets(10, 2, 14),
+	}, []string{"model"})
+	m.requestTokens = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "request_tokens",
+		Help:    "Tokens per request by type (prompt|completion|total), provider and model, for token size percentiles. Providers beyond the cap are recorded as \"other\".",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 12),
+	}, []string{"type", "provider", "model"})
+	m.providerCapper = newLabelCapper(maxProviderLabels)
+	m.zeroUsage = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zero_usage_responses_total",
+		Help: "Responses whose parsed usage was all zero, by model, as opposed to responses whose usage couldn't be parsed.",
+	}, []string{"model"})
+	m.responseFormats = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "response_format_total",
+		Help: "Responses by the parser path usage was parsed on: the parser, with ;fallback for unrecognised content types and ;estimated for estimated usage.",
+	}, []string{"format"})
+	m.missingEndOfStream = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "missing_end_of_stream_total",
+		Help: "Responses whose usage was recovered without EndOfStream, by trigger (idle|response_timeout).",
+	}, []string{"trigger"})
+	m.modelDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tenant_model_denials_total",
+		Help: "Requests rejected with a 403 for a model not on the tenant's tenant_models list, by tenant.",
+	}, []string{"tenant"})
+	m.responseOverflows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "response_body_overflow_total",
+		Help: "Response bodies that outgrew a buffer limit and passed through without their usage parsed, by limit (model|budget).",
+	}, []string{"limit"})
+	reg.MustRegister(m.tokens, m.inFlight, m.completionBreakdown, m.fingerprints, m.modelOverflows, m.requestModes, m.rateLimitCalls, m.serverTimings, m.refusals, m.bufferedBytes, m.bufferSkipped, m.estimateRatio, m.contextUtilization, m.choices, m.choiceTokens, m.costTiers, m.credits, m.parses, m.shadowParses, m.sinkDropped, m.sinkDeadLetters, m.nonGRPCConns, m.frameDuration, m.budgetExceeded, m.providerErrors, m.panics, m.upstreamServiceTime, m.requestTokens, m.zeroUsage, m.responseFormats, m.missingEndOfStream, m.modelDenials, m.responseOverflows)
+	return m
+}
+
+// batchTokens starts batching tokens_total increments, flushing them every
+// interval. It must be called before any tokens are recorded.
+func (m *metrics) batchTokens(interval time.Duration) {
+	m.tokenBatch = newCounterBatch(m.tokens, interval)
+}
+
+// flush adds any batched increments to the registry and stops batching;
+// later increments are added directly.
+func (m *metrics) flush() {
+	if m.tokenBatch != nil {
+		m.tokenBatch.close()
+	}
+}
+
+// recordTokens adds usage to the token counters, scaled by weight. retry is
+// true when the usage came from an Envoy retry rather than the first attempt.
+// headerValues holds the request's values for the configured header labels.
+func (m *metrics) recordTokens(endpoint string, retry bool, headerValues []string, usage *tokenUsage, weight float64) {
+	labels := make([]string, 3, 3+len(headerValues))
+	labels[1] = endpoint
+	labels[2] = "first"
+	if retry {
+		labels[2] = "retry"
+	}
+	for i, v := range headerValues {
+		labels = append(labels, m.labelCappers[i].value(v))
+	}
+	add := func(tokenType string, n int64) {
+		labels[0] = tokenType
+		if m.tokenBatch != nil {
+			m.tokenBatch.add(labels, float64(n)*weight)
+			return
+		}
+		m.tokens.WithLabelValues(labels...).Add(float64(n) * weight)
+	}
+	add("prompt", usage.PromptTokens)
+	if endpoint != endpointEmbeddings {
+		add("completion", usage.CompletionTokens)
+	}
+	add("total", usage.TotalTokens)
+
+	if usage.SystemFingerprint != "" {
+		m.fingerprints.WithLabelValues(m.fingerprintCapper.value(usage.SystemFingerprint)).Inc()
+	}
+
+	if usage.Choices > 0 {
+		m.choices.Observe(float64(usage.Choices))
+	}
+	for _, n := range usage.ChoiceCompletionTokens {
+		m.choiceTokens.Observe(float64(n))
+	}
+
+	if usage.ReasoningTokens > 0 {
+		// counters panic on a negative Add, so a provider reporting more
+		// reasoning than completion tokens counts as no visible output
+		visible := max(usage.CompletionTokens-usage.ReasoningTokens, 0)
+		m.completionBreakdown.WithLabelValues("visible").Add(float64(visible) * weight)
+		m.completionBreakdown.WithLabelValues("reasoning").Add(float64(usage.ReasoningTokens) * weight)
+	}
+}
+
+// observeRequestTokens observes a request's token counts in the
+// request_tokens histogram, with exemplar labels, such as its processing
+// or trace id, when there are any. Histograms can't be weighted, so sampled
+// requests are observed once each.
+func (m *metrics) observeRequestTokens(endpoint, provider, model string, exemplar prometheus.Labels, usage *tokenUsage) {
+	if provider == "" {
+		provider = "unknown"
+	}
+	provider = m.providerCapper.value(provider)
+	model = m.modelLabel(model)
+	observe := func(tokenType string, n int64) {
+		h := m.requestTokens.WithLabelValues(tokenType, provider, model)
+		if len(exemplar) == 0 {
+			h.Observe(float64(n))
+			return
+		}
+		h.(prometheus.ExemplarObserver).ObserveWithExemplar(float64(n), exemplar)
+	}
+	observe("prompt", usage.PromptTokens)
+	if endpoint != endpointEmbeddings {
+		observe("completion", usage.CompletionTokens)
+	}
+	observe("total", usage.TotalTokens)
+}
+
+// modelLabel returns the label value to record for model, bucketing models
+// past the cap into "other".
+func (m *metrics) modelLabel(model string) string {
+	v := m.modelCapper.value(model)
+	if v == overflowLabel && model != overflowLabel {
+		m.modelOverflows.Inc()
+	}
+	return v
+}
+
+// recordCostTiers adds a tiered model's per-tier cost, scaled by weight.
+func (m *metrics) recordCostTiers(model string, tierUSD []float64, weight float64) {
+	if len(tierUSD) == 0 {
+		return
+	}
+	model = m.modelLabel(model)
+	for i, usd := range tierUSD {
+		m.costTiers.WithLabelValues(model, strconv.Itoa(i)).Add(usd * weight)
+	}
+}
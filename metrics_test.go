@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecordTokensReasoningExceedsCompletion(t *testing.T) {
+	m := newMetrics(prometheus.NewRegistry(), "", nil, 0)
+	usage := &tokenUsage{PromptTokens: 3, CompletionTokens: 5, ReasoningTokens: 8, TotalTokens: 8}
+	m.recordTokens(endpointCompletions, false, nil, usage, 1)
+	if got := testutil.ToFloat64(m.completionBreakdown.WithLabelValues("visible")); got != 0 {
+		t.Errorf("visible = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(m.completionBreakdown.WithLabelValues("reasoning")); got != 8 {
+		t.Errorf("reasoning = %v, want 8", got)
+	}
+}
+
+func TestMetricLabelHeadersConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{name: "reserved", config: "metric_label_headers: [{header: x-team, label: endpoint}]"},
+		{name: "invalid header label", config: "metric_label_headers: [{header: x.team}]"},
+		{name: "invalid explicit label", config: "metric_label_headers: [{header: x-team, label: 1team}]"},
+		{name: "duplicate", config: "metric_label_headers: [{header: x-team}, {header: x-other, label: x_team}]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadConfig(path); err == nil {
+				t.Errorf("%q: want an error", tt.config)
+			}
+		})
+	}
+	// a valid config registers its labels without panicking
+	cfg := testConfig(t, "metric_label_headers: [{header: x-team}, {header: X-App, label: app}]")
+	newMetrics(prometheus.NewRegistry(), "", cfg.MetricLabelHeaders, cfg.MaxModelLabels)
+}
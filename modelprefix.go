@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// defaultModelPrefixSeparator joins provider and model, as in openai/gpt-4o.
+const defaultModelPrefixSeparator = "/"
+
+// modelPrefixConfig namespaces reported model names by provider, so the same
+// model served by several providers can be told apart.
+type modelPrefixConfig struct {
+	// Hosts maps request hosts (:authority, without port) to the provider
+	// name they are reported under. Requests to other hosts are reported
+	// under the provider detected from the response.
+	Hosts map[string]string `json:"hosts"`
+	// Separator goes between provider and model. Defaults to "/".
+	Separator string `json:"separator,omitempty"`
+}
+
+// provider returns the provider for a request's :authority, or "" if the host
+// isn't mapped. A nil config maps nothing.
+func (c *modelPrefixConfig) provider(authority string) string {
+	if c == nil {
+		return ""
+	}
+	host := authority
+	if h, _, err := net.SplitHostPort(authority); err == nil {
+		host = h
+	}
+	return c.Hosts[strings.ToLower(host)]
+}
+
+// qualify prefixes model with provider. Models that are unknown or already
+// carry the prefix are returned as is.
+func (c *modelPrefixConfig) qualify(provider, model string) string {
+	if c == nil || provider == "" || model == "" {
+		return model
+	}
+	prefix := provider + c.Separator
+	if strings.HasPrefix(model, prefix) {
+		return model
+	}
+	return prefix + model
+}
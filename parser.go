@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// tokenUsage is the normalized usage reported by an upstream, independent of
+// the wire format it arrived in.
+type tokenUsage struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	// ReasoningTokens are hidden reasoning tokens, already counted (and
+	// billed) within CompletionTokens.
+	ReasoningTokens int64 `json:"reasoning_tokens,omitempty"`
+
+	// SystemFingerprint identifies the backend configuration that served
+	// the response, when the provider reports one.
+	SystemFingerprint string `json:"system_fingerprint,omitempty"`
+
+	// Choices is the number of choices in the response, e.g. for requests
+	// with n>1. ChoiceCompletionTokens holds each choice's completion tokens
+	// when the provider reports usage per choice, which most report only in
+	// aggregate.
+	Choices                int     `json:"choices,omitempty"`
+	ChoiceCompletionTokens []int64 `json:"-"`
+
+	// CacheReadTokens and CacheWriteTokens are the prompt tokens read from
+	// and written to the provider's prompt cache, already counted within
+	// PromptTokens.
+	CacheReadTokens  int64 `json:"cache_read_tokens,omitempty"`
+	CacheWriteTokens int64 `json:"cache_write_tokens,omitempty"`
+
+	// Refusal is why the model declined to answer, when it did: "refusal"
+	// for an explicit refusal message or "content_filter" when output was
+	// filtered. Providers without these signals never set it.
+	Refusal string `json:"refusal,omitempty"`
+
+	// Estimated is set when the response reported no usage and the counts
+	// were estimated from its streamed text.
+	Estimated bool `json:"tokens_estimated,omitempty"`
+}
+
+const (
+	refusalMessage       = "refusal"
+	refusalContentFilter = "content_filter"
+)
+
+// openAIUsage is the wire format of an OpenAI usage object. It also accepts
+// the Responses API's and Anthropic's input_tokens/output_tokens naming and
+// prompt caching fields.
+type openAIUsage struct {
+	PromptTokens            int64 `json:"prompt_tokens"`
+	TotalTokens             int64 `json:"total_tokens"`
+	CompletionTokens        int64 `json:"completion_tokens"`
+	CompletionTokensDetails struct {
+		ReasoningTokens int64 `json:"reasoning_tokens"`
+	} `json:"completion_tokens_details"`
+	PromptTokensDetails struct {
+		CachedTokens int64 `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+
+	InputTokens  int64 `json:"input_tokens"`
+	OutputTokens int64 `json:"output_tokens"`
+
+	// The Responses API counts cached tokens within input_tokens and
+	// reasoning tokens within output_tokens.
+	InputTokensDetails struct {
+		CachedTokens int64 `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+	OutputTokensDetails struct {
+		ReasoningTokens int64 `json:"reasoning_tokens"`
+	} `json:"output_tokens_details"`
+
+	// Anthropic reports input_tokens excluding cached tokens, with cache
+	// reads and writes counted separately.
+	CacheCreationInputTokens int64 `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64 `json:"cache_read_input_tokens"`
+}
+
+// openAIResponse is the part of an OpenAI response, or streamed chunk, that
+// usage is read from. Responses API responses carry output items instead of
+// choices, and their streamed events wrap the response in Response.
+type openAIResponse struct {
+	Usage             *openAIUsage   `json:"usage"`
+	SystemFingerprint string         `json:"system_fingerprint"`
+	Choices           []openAIChoice `json:"choices"`
+
+	Output   []responsesOutput `json:"output"`
+	Response *openAIResponse   `json:"response"`
+}
+
+// responsesOutput is an output item of a Responses API response.
+type responsesOutput struct {
+	Content []struct {
+		Type string `json:"type"`
+	} `json:"content"`
+}
+
+// unwrap returns the response a Responses API stream event (e.g.
+// response.completed) carries, or r itself for any other chunk.
+func (r *openAIResponse) unwrap() *openAIResponse {
+	if r.Response != nil {
+		return r.Response
+	}
+	return r
+}
+
+// openAIChoice is one choice of a response. Usage is only set by providers
+// that report usage per choice.
+type openAIChoice struct {
+	Index        int          `json:"index"`
+	Usage        *openAIUsage `json:"usage"`
+	FinishReason string       `json:"finish_reason"`
+	// Message is set on complete responses and Delta on streamed chunks.
+	Message struct {
+		Refusal string `json:"refusal"`
+	} `json:"message"`
+	Delta struct {
+		Refusal string `json:"refusal"`
+	} `json:"delta"`
+}
+
+// refusal returns why the choice was refused, or "" if it wasn't.
+func (c *openAIChoice) refusal() string {
+	switch {
+	case c.Message.Refusal != "" || c.Delta.Refusal != "":
+		return refusalMessage
+	case c.FinishReason == refusalContentFilter:
+		return refusalContentFilter
+	}
+	return ""
+}
+
+// refusal returns why any choice or output item of the response was
+// refused, or "".
+func (r *openAIResponse) refusal() string {
+	for i := range r.Choices {
+		if reason := r.Choices[i].refusal(); reason != "" {
+			return reason
+		}
+	}
+	for _, item := range r.Output {
+		for _, c := range item.Content {
+			if c.Type == refusalMessage {
+				return refusalMessage
+			}
+		}
+	}
+	return ""
+}
+
+// usage returns the normalized usage, or nil if the response carries none.
+func (r *openAIResponse) usage() *tokenUsage {
+	if r.Usage == nil {
+		return nil
+	}
+	u := r.Usage.normalize()
+	u.SystemFingerprint = r.SystemFingerprint
+	u.Choices = len(r.Choices)
+	u.ChoiceCompletionTokens = r.choiceCompletionTokens()
+	u.Refusal = r.refusal()
+	return u
+}
+
+// choiceCompletionTokens returns each choice's completion tokens, or nil
+// unless every choice reports its own usage.
+func (r *openAIResponse) choiceCompletionTokens() []int64 {
+	if len(r.Choices) < 2 {
+		return nil
+	}
+	tokens := make([]int64, len(r.Choices))
+	for i, c := range r.Choices {
+		if c.Usage == nil {
+			return nil
+		}
+		tokens[i] = c.Usage.CompletionTokens
+	}
+	return tokens
+}
+
+func (u *openAIUsage) normalize() *tokenUsage {
+	t := &tokenUsage{
+		PromptTokens:     u.PromptTokens,
+		TotalTokens:      u.TotalTokens,
+		CompletionTokens: u.CompletionTokens,
+		ReasoningTokens:  u.CompletionTokensDetails.ReasoningTokens,
+		CacheReadTokens:  u.PromptTokensDetails.CachedTokens,
+	}
+	if u.OutputTokensDetails.ReasoningTokens != 0 {
+		t.ReasoningTokens = u.OutputTokensDetails.ReasoningTokens
+	}
+	if u.InputTokensDetails.CachedTokens != 0 {
+		t.CacheReadTokens = u.InputTokensDetails.CachedTokens
+	}
+	if u.CacheReadInputTokens != 0 || u.CacheCreationInputTokens != 0 {
+		t.CacheReadTokens = u.CacheReadInputTokens
+		t.CacheWriteTokens = u.CacheCreationInputTokens
+	}
+	if u.PromptTokens == 0 && u.CompletionTokens == 0 {
+		t.PromptTokens = u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+		t.CompletionTokens = u.OutputTokens
+	}
+	return t
+}
+
+// validate checks the counts are neither negative nor above limit, and that
+// reasoning tokens, which are part of the completion, don't exceed it. With
+// clamp set, out-of-range counts are clamped instead of rejected.
+func (u *tokenUsage) validate(limit int64, clamp bool) error {
+	// a slice rather than a map so the first out-of-range count reported is
+	// always the same one
+	for _, c := range []struct {
+		name string
+		n    *int64
+	}{
+		{"prompt_tokens", &u.PromptTokens},
+		{"completion_tokens", &u.CompletionTokens},
+		{"total_tokens", &u.TotalTokens},
+		{"reasoning_tokens", &u.ReasoningTokens},
+		{"cache_read_tokens", &u.CacheReadTokens},
+		{"cache_write_tokens", &u.CacheWriteTokens},
+	} {
+		if *c.n >= 0 && *c.n <= limit {
+			continue
+		}
+		if !clamp {
+			return fmt.Errorf("%s %d out of range [0, %d]", c.name, *c.n, limit)
+		}
+		*c.n = min(max(*c.n, 0), limit)
+	}
+	if u.ReasoningTokens > u.CompletionTokens {
+		if !clamp {
+			return fmt.Errorf("reasoning_tokens %d exceeds completion_tokens %d", u.ReasoningTokens, u.CompletionTokens)
+		}
+		u.ReasoningTokens = u.CompletionTokens
+	}
+	return nil
+}
+
+// deriveTotal fills in TotalTokens from its components when the provider
+// omitted it. Usage with no components at all is left as genuinely unknown.
+func (u *tokenUsage) deriveTotal() {
+	if u.TotalTokens == 0 {
+		u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	}
+}
+
+const (
+	endpointCompletions = "completions"
+	endpointEmbeddings  = "embeddings"
+)
+
+// detectEndpoint classifies a response as embeddings or completions, by the
+// request path or, failing that, by a JSON body carrying embedding data rather
+// than choices.
+func detectEndpoint(path, contentType string, body []byte) string {
+	if p, _, _ := strings.Cut(path, "?"); strings.HasSuffix(p, "/embeddings") {
+		return endpointEmbeddings
+	}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "" && mediaType != "application/json" {
+		return endpointCompletions
+	}
+	var resp struct {
+		Object  string            `json:"object"`
+		Data    []json.RawMessage `json:"data"`
+		Choices []json.RawMessage `json:"choices"`
+	}
+	if json.Unmarshal(body, &resp) == nil && resp.Choices == nil && resp.Object == "list" && resp.Data != nil {
+		return endpointEmbeddings
+	}
+	return endpointCompletions
+}
+
+// usageEndpointSuffixes are request path suffixes of the completions and
+// embeddings endpoints of the supported APIs, all of which report usage.
+var usageEndpointSuffixes = []string{
+	"/completions",
+	"/embeddings",
+	"/responses",
+	"/messages",
+	":generateContent",
+	":streamGenerateContent",
+	":embedContent",
+	":batchEmbedContents",
+}
+
+// isUsageEndpoint reports whether a response came from a completions or
+// embeddings endpoint, which always reports usage, by the request path or,
+// failing that, by a streamed body or a JSON body shaped like a completion
+// or embeddings response. Anything else, such as /v1/models or a health
+// check, legitimately carries no usage.
+func isUsageEndpoint(path, contentType string, body []byte) bool {
+	p, _, _ := strings.Cut(path, "?")
+	for _, suffix := range usageEndpointSuffixes {
+		if strings.HasSuffix(p, suffix) {
+			return true
+		}
+	}
+	switch mediaType, _, _ := mime.ParseMediaType(contentType); mediaType {
+	case "text/event-stream", "application/x-ndjson", "application/jsonl":
+		return true
+	}
+	var resp struct {
+		Object string `json:"object"`
+		Type   string `json:"type"`
+		Data   []struct {
+			Embedding json.RawMessage `json:"embedding"`
+		} `json:"data"`
+		Choices    json.RawMessage `json:"choices"`
+		Output     json.RawMessage `json:"output"`
+		Candidates json.RawMessage `json:"candidates"`
+	}
+	if json.Unmarshal(body, &resp) != nil {
+		return false
+	}
+	switch {
+	case resp.Choices != nil, resp.Output != nil, resp.Candidates != nil, resp.Type == "message":
+		return true
+	case resp.Object == "list" && len(resp.Data) > 0 && resp.Data[0].Embedding != nil:
+		return true
+	}
+	return false
+}
+
+// usageParser is a registered decoder for one response format.
+type usageParser struct {
+	Name string `json:"name"`
+	// ContentTypes are the response media types that select this parser.
+	ContentTypes []string `json:"content_types"`
+	// Fallback marks the parser used for any other content type.
+	Fallback bool `json:"fallback,omitempty"`
+	// Headers are the response headers the parser's usage can emit.
+	Headers []string `json:"headers"`
+
+	parse func(body []byte) (*tokenUsage, error)
+}
+
+// parsers is the registry of usage parsers, selected by response content type.
+// Any of them can also be run as a shadow parser.
+var parsers = []*usageParser{
+	{
+		Name:         "json",
+		ContentTypes: []string{"application/json"},
+		Fallback:     true,
+		Headers:      usageHeaders,
+		parse:        parseJSONUsage,
+	},
+	{
+		Name:         "form",
+		ContentTypes: []string{"application/x-www-form-urlencoded"},
+		Headers:      usageHeaders,
+		parse:        parseFormUsage,
+	},
+	{
+		Name:         "sse",
+		ContentTypes: []string{"text/event-stream"},
+		Headers:      usageHeaders,
+		parse:        parseSSEUsage,
+	},
+	{
+		Name:         "ndjson",
+		ContentTypes: []string{"application/x-ndjson", "application/jsonl"},
+		Headers:      usageHeaders,
+		parse:        parseNDJSONUsage,
+	},
+}
+
+// lookupParser returns the registered parser with the given name, or nil.
+func lookupParser(name string) *usageParser {
+	for _, p := range parsers {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// parserFor returns the parser for a response content type captured in
+// ResponseHeaders, falling back to the fallback parser for unrecognised
+// types, and whether it fell back.
+func parserFor(contentType string) (parser *usageParser, fellBack bool) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	var fallback *usageParser
+	for _, p := range parsers {
+		if slices.Contains(p.ContentTypes, mediaType) {
+			return p, false
+		}
+		if p.Fallback {
+			fallback = p
+		}
+	}
+	return fallback, true
+}
+
+// parseJSONUsage parses OpenAI-style usage metrics, from chat completions or
+// Responses API bodies.
+func parseJSONUsage(body []byte) (*tokenUsage, error) {
+	var resp openAIResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	openAIResp := resp.unwrap()
+	if u := openAIResp.usage(); u != nil {
+		return u, nil
+	}
+	return &tokenUsage{SystemFingerprint: openAIResp.SystemFingerprint, Refusal: openAIResp.refusal()}, nil
+}
+
+// parseSSEUsage parses usage from a server-sent event stream, such as an
+// OpenAI streaming response with stream_options.include_usage or a Responses
+// API stream, whose response.completed event carries the usage. The usage of
+// the last event that carries one wins.
+func parseSSEUsage(body []byte) (*tokenUsage, error) {
+	var chunks streamedChunks
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+		if !ok {
+			continue
+		}
+		chunks.add(bytes.TrimSpace(data))
+	}
+	if chunks.usage == nil {
+		return nil, errors.New("no usage in event stream")
+	}
+	return chunks.result(), nil
+}
+
+// parseNDJSONUsage parses usage from newline-delimited JSON, where each line
+// is a chunk. The usage of the last chunk that carries one wins.
+func parseNDJSONUsage(body []byte) (*tokenUsage, error) {
+	var chunks streamedChunks
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		chunks.add(bytes.TrimSpace(line))
+	}
+	if chunks.usage == nil {
+		return nil, errors.New("no usage in NDJSON stream")
+	}
+	return chunks.result(), nil
+}
+
+// streamedChunks accumulates the streamed JSON chunks of a response: the
+// usage of the last chunk that carries one, and the number of distinct choice
+// indices seen across all chunks.
+type streamedChunks struct {
+	usage   *tokenUsage
+	choices map[int]struct{}
+	refusal string
+}
+
+// add records a single chunk. Chunks that aren't JSON (e.g. the [DONE]
+// sentinel) are ignored.
+func (c *streamedChunks) add(data []byte) {
+	var event openAIResponse
+	if len(data) == 0 || json.Unmarshal(data, &event) != nil {
+		return
+	}
+	chunk := event.unwrap()
+	for _, choice := range chunk.Choices {
+		if c.choices == nil {
+			c.choices = make(map[int]struct{})
+		}
+		c.choices[choice.Index] = struct{}{}
+	}
+	if reason := chunk.refusal(); reason != "" && c.refusal == "" {
+		c.refusal = reason
+	}
+	if u := chunk.usage(); u != nil {
+		c.usage = u
+	}
+}
+
+func (c *streamedChunks) result() *tokenUsage {
+	c.usage.Choices = len(c.choices)
+	c.usage.Refusal = c.refusal
+	return c.usage
+}
+
+// parseFormUsage parses usage from legacy servers that respond with
+// form-encoded bodies, e.g. prompt_tokens=10&completion_tokens=20.
+func parseFormUsage(body []byte) (*tokenUsage, error) {
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	var usage tokenUsage
+	found := false
+	for key, dst := range map[string]*int64{
+		"prompt_tokens":     &usage.PromptTokens,
+		"total_tokens":      &usage.TotalTokens,
+		"completion_tokens": &usage.CompletionTokens,
+	} {
+		v := values.Get(key)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		*dst = n
+		found = true
+	}
+	if !found {
+		return nil, errors.New("no usage fields in form body")
+	}
+	return &usage, nil
+}
+
+// requestInfo is what we learn from an OpenAI-style request body.
+type requestInfo struct {
+	Model        string
+	MaxTokens    int64
+	MessageCount int
+	// EstimatedTokens is a rough estimate of the request's total tokens, or
+	// 0 when none could be made, and EstimatedPromptTokens of its prompt.
+	EstimatedTokens       int64
+	EstimatedPromptTokens int64
+}
+
+// parseRequest extracts the model, resolving any alias, max_tokens and
+// message count from a request body, and estimates its tokens with tok
+// unless tok is nil. Fields that can't be determined are left zero.
+func parseRequest(body []byte, aliases map[string]string, tok Tokenizer) requestInfo {
+	var req struct {
+		Model               string            `json:"model"`
+		MaxTokens           int64             `json:"max_tokens"`
+		MaxCompletionTokens int64             `json:"max_completion_tokens"`
+		Messages            []json.RawMessage `json:"messages"`
+		Prompt              json.RawMessage   `json:"prompt"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return requestInfo{}
+	}
+	info := requestInfo{
+		Model:        resolveModel(aliases, req.Model),
+		MaxTokens:    req.MaxTokens,
+		MessageCount: len(req.Messages),
+	}
+	if req.MaxCompletionTokens != 0 {
+		info.MaxTokens = req.MaxCompletionTokens
+	}
+	if tok == nil {
+		return info
+	}
+	info.EstimatedPromptTokens = int64(tok.CountTokens(info.Model, promptText(req.Messages, req.Prompt)))
+	if info.EstimatedPromptTokens > 0 || info.MaxTokens > 0 {
+		info.EstimatedTokens = info.EstimatedPromptTokens + info.MaxTokens
+	}
+	return info
+}
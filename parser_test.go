@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseUsageFixtures(t *testing.T) {
+	tests := []struct {
+		fixture     string
+		contentType string
+		want        tokenUsage
+	}{
+		{
+			fixture:     "form_usage.txt",
+			contentType: "application/x-www-form-urlencoded",
+			want:        tokenUsage{PromptTokens: 10, CompletionTokens: 20, TotalTokens: 30},
+		},
+		{
+			fixture:     "openai_cached.json",
+			contentType: "application/json",
+			want:        tokenUsage{PromptTokens: 2006, CompletionTokens: 300, TotalTokens: 2306, Choices: 1, CacheReadTokens: 1920},
+		},
+		{
+			fixture:     "o1_reasoning.json",
+			contentType: "application/json",
+			want: tokenUsage{
+				PromptTokens: 14, CompletionTokens: 1353, TotalTokens: 1367, ReasoningTokens: 1280,
+				SystemFingerprint: "fp_o1", Choices: 1,
+			},
+		},
+		{
+			// past int32 and float32 precision
+			fixture:     "large_counts.json",
+			contentType: "application/json",
+			want:        tokenUsage{PromptTokens: 5_000_000_000, CompletionTokens: 2_500_000_001, TotalTokens: 7_500_000_001, Choices: 1},
+		},
+		{
+			fixture:     "anthropic_cached.json",
+			contentType: "application/json",
+			want:        tokenUsage{PromptTokens: 2009, CompletionTokens: 393, CacheReadTokens: 1800, CacheWriteTokens: 188},
+		},
+		{
+			fixture:     "responses.json",
+			contentType: "application/json",
+			want:        tokenUsage{PromptTokens: 36, CompletionTokens: 87, TotalTokens: 123},
+		},
+		{
+			fixture:     "responses.sse",
+			contentType: "text/event-stream",
+			want:        tokenUsage{PromptTokens: 9, CompletionTokens: 30, TotalTokens: 39, ReasoningTokens: 24, CacheReadTokens: 4},
+		},
+		{
+			fixture:     "chat_n3.json",
+			contentType: "application/json",
+			want: tokenUsage{
+				PromptTokens: 11, CompletionTokens: 9, TotalTokens: 20,
+				SystemFingerprint: "fp_n3", Choices: 3, ChoiceCompletionTokens: []int64{2, 4, 3},
+			},
+		},
+		{
+			fixture:     "chat_n3.sse",
+			contentType: "text/event-stream",
+			want:        tokenUsage{PromptTokens: 11, CompletionTokens: 7, TotalTokens: 18, Choices: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			body, err := os.ReadFile(filepath.Join("testdata", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			parser, _ := parserFor(tt.contentType)
+			got, err := parser.parse(body)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFormUsage(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    tokenUsage
+		wantErr bool
+	}{
+		{name: "partial", body: "prompt_tokens=7", want: tokenUsage{PromptTokens: 7}},
+		{name: "extra fields", body: "model=legacy&completion_tokens=3", want: tokenUsage{CompletionTokens: 3}},
+		{name: "no usage", body: "model=legacy", wantErr: true},
+		{name: "not a number", body: "prompt_tokens=ten", wantErr: true},
+		{name: "invalid encoding", body: "prompt_tokens=%zz", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFormUsage([]byte(tt.body))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want error", *got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeriveTotalTokens(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "chat_no_total.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		config string
+		want   int64
+	}{
+		{config: "", want: 17},
+		{config: "strict_total_tokens: true", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.config, func(t *testing.T) {
+			s := newTestServer(t, testConfig(t, tt.config))
+			usage, err := s.parseResponseUsage(responseState("200", "application/json", body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if usage.TotalTokens != tt.want {
+				t.Errorf("total_tokens = %d, want %d", usage.TotalTokens, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateReasoningTokens(t *testing.T) {
+	usage := tokenUsage{CompletionTokens: 5, ReasoningTokens: 8}
+	if err := usage.validate(1000, false); err == nil {
+		t.Error("want an error for reasoning_tokens above completion_tokens")
+	}
+	if err := usage.validate(1000, true); err != nil {
+		t.Fatal(err)
+	}
+	if usage.ReasoningTokens != 5 {
+		t.Errorf("reasoning_tokens = %d, want clamped to 5", usage.ReasoningTokens)
+	}
+}
+
+func TestValidateReportsFirstField(t *testing.T) {
+	for range 20 {
+		usage := tokenUsage{PromptTokens: -1, CompletionTokens: -1, TotalTokens: -1, CacheReadTokens: -1}
+		err := usage.validate(1000, false)
+		if err == nil || err.Error() != "prompt_tokens -1 out of range [0, 1000]" {
+			t.Fatalf("got %v, want prompt_tokens reported first", err)
+		}
+	}
+}
+
+func TestValidateDerivedTotal(t *testing.T) {
+	s := newTestServer(t, testConfig(t, "max_token_count: 1000"))
+	body := []byte(`{"usage":{"prompt_tokens":600,"completion_tokens":600}}`)
+	if _, err := s.parseResponseUsage(responseState("200", "application/json", body)); err == nil {
+		t.Error("want a derived total above max_token_count rejected")
+	}
+}
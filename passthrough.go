@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"slices"
+	"strings"
+
+	configPb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	filterPb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// passthroughConfig identifies requests that clearly aren't LLM traffic, so
+// routes that mostly carry LLM calls don't buffer everything else.
+type passthroughConfig struct {
+	// Paths are request path prefixes that are passed through.
+	Paths []string `json:"paths,omitempty"`
+	// ContentTypes are request media types that are passed through, e.g.
+	// multipart/form-data uploads.
+	ContentTypes []string `json:"content_types,omitempty"`
+}
+
+// matches reports whether a request should be passed through without any body
+// processing. A nil config passes nothing through.
+func (c *passthroughConfig) matches(path, contentType string) bool {
+	if c == nil {
+		return false
+	}
+	for _, prefix := range c.Paths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType != "" && slices.Contains(c.ContentTypes, mediaType)
+}
+
+// passthroughResponse answers RequestHeaders with a ModeOverride that turns
+// off the rest of the request's processing.
+func passthroughResponse() *extProcPb.ProcessingResponse {
+	return &extProcPb.ProcessingResponse{
+		Response: &extProcPb.ProcessingResponse_RequestHeaders{
+			RequestHeaders: &extProcPb.HeadersResponse{},
+		},
+		ModeOverride: &filterPb.ProcessingMode{
+			RequestBodyMode:    filterPb.ProcessingMode_NONE,
+			ResponseHeaderMode: filterPb.ProcessingMode_SKIP,
+			ResponseBodyMode:   filterPb.ProcessingMode_NONE,
+		},
+	}
+}
+
+// metadataFlag is a boolean in the metadata Envoy forwards with a request,
+// named namespace.key, e.g. token_accounting.enabled. The namespace may
+// itself contain dots; the key is what follows the last one.
+type metadataFlag struct {
+	namespace string
+	key       string
+}
+
+func parseMetadataFlag(name string) (metadataFlag, error) {
+	i := strings.LastIndexByte(name, '.')
+	if i <= 0 || i == len(name)-1 {
+		return metadataFlag{}, fmt.Errorf("%q must be namespace.key", name)
+	}
+	return metadataFlag{namespace: name[:i], key: name[i+1:]}, nil
+}
+
+// enabled reports the flag's value in md. It is true when the flag is
+// absent or isn't a bool, so routes without it are processed.
+func (f metadataFlag) enabled(md *configPb.Metadata) bool {
+	v, ok := md.GetFilterMetadata()[f.namespace].GetFields()[f.key].GetKind().(*structpb.Value_BoolValue)
+	return !ok || v.BoolValue
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// http2Preface is the connection preface every HTTP/2, and so gRPC, client
+// sends first.
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+var errNotGRPC = errors.New("connection did not open with the HTTP/2 preface")
+
+const nonGRPCResponse = "HTTP/1.1 400 Bad Request\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Connection: close\r\n" +
+	"Content-Length: 35\r\n" +
+	"\r\n" +
+	"this port only serves gRPC ext_proc"
+
+// grpcOnlyListener rejects connections that don't open with the HTTP/2
+// preface, such as HTTP/1.1 health scanners or misconfigured clients hitting
+// the data port. They get a plain 400 and a single log line instead of
+// confusing transport errors from the gRPC server.
+type grpcOnlyListener struct {
+	net.Listener
+	rejected prometheus.Counter
+}
+
+func (l *grpcOnlyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &prefaceConn{Conn: c, rejected: l.rejected}, nil
+}
+
+// prefaceConn checks the client preface before the first Read or Write. The
+// gRPC server makes both from the connection's own goroutine, so a slow client
+// never holds up Accept, and holding back its Write keeps the server's HTTP/2
+// settings frame from being sent to a client that isn't speaking HTTP/2.
+type prefaceConn struct {
+	net.Conn
+	rejected prometheus.Counter
+
+	once sync.Once
+	err  error
+	// preface holds the verified preface until the server has read it.
+	preface []byte
+}
+
+func (c *prefaceConn) check() error {
+	c.once.Do(func() {
+		c.preface, c.err = c.readPreface()
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+	return c.err
+}
+
+func (c *prefaceConn) Read(p []byte) (int, error) {
+	if c.check() != nil {
+		// io.EOF keeps the gRPC server from logging the failed handshake
+		return 0, io.EOF
+	}
+	if len(c.preface) > 0 {
+		n := copy(p, c.preface)
+		c.preface = c.preface[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *prefaceConn) Write(p []byte) (int, error) {
+	if err := c.check(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
+
+// readPreface reads until the client has sent the whole preface, rejecting
+// it as soon as what it sent stops matching.
+func (c *prefaceConn) readPreface() ([]byte, error) {
+	buf := make([]byte, len(http2Preface))
+	n := 0
+	for n < len(buf) {
+		m, err := c.Conn.Read(buf[n:])
+		n += m
+		if !bytes.HasPrefix([]byte(http2Preface), buf[:n]) {
+			c.reject(buf[:n])
+			return nil, errNotGRPC
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func (c *prefaceConn) reject(start []byte) {
+	c.rejected.Inc()
+	line, _, _ := bytes.Cut(start, []byte("\r\n"))
+	mainLog.Infof("Rejected non-gRPC connection from %s (%q)", c.RemoteAddr(), line)
+	if looksLikeHTTP1(start) {
+		io.WriteString(c.Conn, nonGRPCResponse)
+	}
+}
+
+// looksLikeHTTP1 reports whether a connection opened with an HTTP/1.x request
+// line.
+func looksLikeHTTP1(start []byte) bool {
+	method, _, ok := bytes.Cut(start, []byte(" "))
+	if !ok || len(method) == 0 {
+		return false
+	}
+	for _, b := range method {
+		if b < 'A' || b > 'Z' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+package main
+
+// modelPricing is a model's price in USD per million tokens.
+type modelPricing struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+	// Embedding is the input rate for embeddings requests. When unset the
+	// prompt rate is used.
+	Embedding float64 `json:"embedding,omitempty"`
+	// CacheRead and CacheWrite are the rates for prompt tokens read from or
+	// written to the provider's prompt cache. When unset those tokens are
+	// charged at the prompt rate. They don't apply to tiered pricing.
+	CacheRead  float64 `json:"cache_read,omitempty"`
+	CacheWrite float64 `json:"cache_write,omitempty"`
+	// Tiers, when set, replace the flat prompt and completion rates with
+	// marginal rates: each tier prices the tokens between the previous
+	// tier's bound and its own.
+	Tiers []pricingTier `json:"tiers,omitempty"`
+}
+
+// pricingTier prices prompt and completion tokens up to UpTo (exclusive) at
+// its own rates. The last tier has no bound.
+type pricingTier struct {
+	UpTo       int64   `json:"up_to,omitempty"`
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// costQuote is the cost of a request, with the share of each pricing tier
+// when the model is tiered.
+type costQuote struct {
+	USD     float64
+	TierUSD []float64
+	// Estimated is set when the model had no pricing of its own and was
+	// costed at the default rate.
+	Estimated bool
+}
+
+// cost prices usage on the given endpoint. Reasoning tokens are part of
+// CompletionTokens and so are charged at the completion rate.
+func (p modelPricing) cost(endpoint string, u *tokenUsage) costQuote {
+	if endpoint == endpointEmbeddings && p.Embedding != 0 {
+		return costQuote{USD: float64(u.PromptTokens) * p.Embedding / 1e6}
+	}
+	if len(p.Tiers) == 0 {
+		return costQuote{USD: (p.promptCost(u) + float64(u.CompletionTokens)*p.Completion) / 1e6}
+	}
+	q := costQuote{TierUSD: make([]float64, len(p.Tiers))}
+	var from int64
+	for i, t := range p.Tiers {
+		inTier := func(n int64) float64 {
+			if t.UpTo == 0 {
+				return float64(max(n-from, 0))
+			}
+			return float64(max(min(n, t.UpTo)-from, 0))
+		}
+		q.TierUSD[i] = (inTier(u.PromptTokens)*t.Prompt + inTier(u.CompletionTokens)*t.Completion) / 1e6
+		q.USD += q.TierUSD[i]
+		from = t.UpTo
+	}
+	return q
+}
+
+// promptCost is the cost of the prompt in USD per million tokens, with cached
+// tokens at their own rates when configured.
+func (p modelPricing) promptCost(u *tokenUsage) float64 {
+	uncached := float64(u.PromptTokens)
+	cost := 0.0
+	if p.CacheRead != 0 {
+		uncached -= float64(u.CacheReadTokens)
+		cost += float64(u.CacheReadTokens) * p.CacheRead
+	}
+	if p.CacheWrite != 0 {
+		uncached -= float64(u.CacheWriteTokens)
+		cost += float64(u.CacheWriteTokens) * p.CacheWrite
+	}
+	return cost + max(uncached, 0)*p.Prompt
+}
+
+// pricingTable maps model names to their pricing. The defaultPricingModel
+// entry, if any, prices models that have no entry of their own.
+type pricingTable map[string]modelPricing
+
+const defaultPricingModel = "default"
+
+// pricing layers per-tenant negotiated rates over the base pricing table.
+type pricing struct {
+	base    pricingTable
+	tenants map[string]pricingTable
+}
+
+// maxCost prices the most a completions request can cost before it runs:
+// its estimated prompt plus all of max_tokens as completion. It returns false
+// when the request sets no max_tokens or no pricing applies.
+func (p pricing) maxCost(tenant, model string, req requestInfo) (costQuote, bool) {
+	if req.MaxTokens == 0 {
+		return costQuote{}, false
+	}
+	return p.cost(tenant, model, endpointCompletions, &tokenUsage{
+		PromptTokens:     req.EstimatedPromptTokens,
+		CompletionTokens: req.MaxTokens,
+		TotalTokens:      req.EstimatedPromptTokens + req.MaxTokens,
+	})
+}
+
+// configured reports whether any pricing is configured at all.
+func (p pricing) configured() bool {
+	return len(p.base) > 0 || len(p.tenants) > 0
+}
+
+// cost prices usage for model, using the tenant's override when it has one
+// and the base rate otherwise. Models without either are estimated at the
+// tenant's or base default rate. It returns false if no pricing applies.
+func (p pricing) cost(tenant, model, endpoint string, u *tokenUsage) (costQuote, bool) {
+	if mp, ok := p.tenants[tenant][model]; ok {
+		return mp.cost(endpoint, u), true
+	}
+	if mp, ok := p.base[model]; ok {
+		return mp.cost(endpoint, u), true
+	}
+	for _, table := range []pricingTable{p.tenants[tenant], p.base} {
+		if mp, ok := table[defaultPricingModel]; ok {
+			q := mp.cost(endpoint, u)
+			q.Estimated = true
+			return q, true
+		}
+	}
+	return costQuote{}, false
+}
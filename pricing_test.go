@@ -0,0 +1,104 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+)
+
+func TestTenantPricing(t *testing.T) {
+	s := newTestServer(t, testConfig(t, `
+tenant_header: x-tenant-id
+pricing:
+  gpt-4o:
+    prompt: 2.50
+    completion: 10.00
+tenant_pricing:
+  acme:
+    gpt-4o:
+      prompt: 2.00
+      completion: 8.00
+`))
+	body := string(readFixture(t, "chat_no_total.json"))
+	tests := []struct {
+		tenant string
+		want   string
+	}{
+		{tenant: "acme", want: "0.000064"},
+		{tenant: "globex", want: "0.00008"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tenant, func(t *testing.T) {
+			sent := process(t, s, []*extProcPb.ProcessingRequest{
+				requestHeaders(":path", "/v1/chat/completions", "x-tenant-id", tt.tenant),
+				requestBody(`{"model":"gpt-4o"}`),
+				responseHeaders(":status", "200", "content-type", "application/json"),
+				responseBody(body, true),
+			}...)
+			if got := setHeaders(sent[len(sent)-1])[headerCostUSD]; got != tt.want {
+				t.Errorf("cost = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTieredPricing(t *testing.T) {
+	p := modelPricing{Tiers: []pricingTier{
+		{UpTo: 100, Prompt: 1, Completion: 2},
+		{Prompt: 10, Completion: 20},
+	}}
+	tests := []struct {
+		name  string
+		usage tokenUsage
+		want  []float64
+	}{
+		{name: "within first tier", usage: tokenUsage{PromptTokens: 60, CompletionTokens: 40}, want: []float64{140e-6, 0}},
+		{name: "prompt spans tiers", usage: tokenUsage{PromptTokens: 150, CompletionTokens: 50}, want: []float64{200e-6, 500e-6}},
+		{name: "both span tiers", usage: tokenUsage{PromptTokens: 120, CompletionTokens: 110}, want: []float64{300e-6, 400e-6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := p.cost(endpointCompletions, &tt.usage)
+			if len(q.TierUSD) != len(tt.want) {
+				t.Fatalf("got %d tiers, want %d", len(q.TierUSD), len(tt.want))
+			}
+			var total float64
+			for i, want := range tt.want {
+				if math.Abs(q.TierUSD[i]-want) > 1e-12 {
+					t.Errorf("tier %d = %v, want %v", i, q.TierUSD[i], want)
+				}
+				total += want
+			}
+			if math.Abs(q.USD-total) > 1e-12 {
+				t.Errorf("total = %v, want %v", q.USD, total)
+			}
+		})
+	}
+}
+
+func TestCachePricing(t *testing.T) {
+	p := modelPricing{Prompt: 3, Completion: 15, CacheRead: 0.3, CacheWrite: 3.75}
+	tests := []struct {
+		fixture string
+		// want is in USD per million tokens
+		want float64
+	}{
+		// 21 uncached prompt tokens, 1800 read, 188 written and 393 completion
+		{fixture: "anthropic_cached.json", want: 21*3 + 1800*0.3 + 188*3.75 + 393*15},
+		// 86 uncached prompt tokens, 1920 read and 300 completion
+		{fixture: "openai_cached.json", want: 86*3 + 1920*0.3 + 300*15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			parser, _ := parserFor("application/json")
+			usage, err := parser.parse(readFixture(t, tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.cost(endpointCompletions, usage).USD; math.Abs(got-tt.want/1e6) > 1e-12 {
+				t.Errorf("cost = %v, want %v", got, tt.want/1e6)
+			}
+		})
+	}
+}
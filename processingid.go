@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// headerProcessingID carries the filter's own id for a request, independent
+// of any request id the client sent.
+const headerProcessingID = "x-token-ext-proc-id"
+
+// Formats for processing ids.
+const (
+	processingIDUUID = "uuid"
+	processingIDULID = "ulid"
+)
+
+// crockford is the Crockford base32 alphabet ULIDs are written in.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newProcessingID returns a new id in the given format.
+func newProcessingID(format string) string {
+	if format == processingIDULID {
+		return newULID(time.Now())
+	}
+	return uuid.NewString()
+}
+
+// newULID returns a ULID for t: 48 bits of Unix milliseconds then 80 random
+// bits, as 26 Crockford base32 characters, so ids sort by creation time.
+func newULID(t time.Time) string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(t.UnixMilli())<<16)
+	rand.Read(b[6:])
+	// 128 bits in 26 characters of 5 bits: the first carries just the top 3
+	var out [26]byte
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const headerErrorType = "x-llm-error-type"
+
+// maxErrorTypes caps distinct error type label values. Providers document a
+// dozen or so; the rest come from whatever an upstream chose to send.
+const maxErrorTypes = 50
+
+// providerError is an OpenAI or Anthropic error body. Both nest the category
+// under error.type; Anthropic also sets the top-level type to "error".
+type providerError struct {
+	Type  string `json:"type"`
+	Error *struct {
+		Type string `json:"type"`
+		Code any    `json:"code"`
+	} `json:"error"`
+}
+
+// parseProviderError returns the provider and error type of an error body,
+// or "", "" if it isn't one. The type falls back to OpenAI's error.code,
+// which some compatible servers set instead. Types that aren't plain
+// identifiers are reported as "unknown" so they are safe to use as header
+// values and metric labels.
+func parseProviderError(body []byte) (provider, errType string) {
+	var e providerError
+	if json.Unmarshal(body, &e) != nil || e.Error == nil {
+		return "", ""
+	}
+	provider = "openai"
+	if e.Type == "error" {
+		provider = "anthropic"
+	}
+	errType = e.Error.Type
+	if code, ok := e.Error.Code.(string); ok && errType == "" {
+		errType = code
+	}
+	switch {
+	case errType == "":
+		return "", ""
+	case len(errType) > 64 || strings.ContainsFunc(errType, func(r rune) bool {
+		return !(r == '_' || r == '-' || r == '.' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}):
+		errType = "unknown"
+	}
+	return provider, errType
+}
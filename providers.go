@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// maxProviderLabels caps distinct provider label values. Detected providers
+// are few, but clients can name any provider in x-llm-provider.
+const maxProviderLabels = 20
+
+// serveProviders lists the registered usage parsers, the headers they emit
+// and the content types that select them, so operators can see what the
+// running build supports.
+func serveProviders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(parsers); err != nil {
+		mainLog.Warnf("Failed to write /providers response: %v", err)
+	}
+}
+
+// detectProvider names the API family a response body came from (openai,
+// anthropic or gemini) by its shape, or returns "" when it can't tell. Event
+// streams and NDJSON are judged by their first JSON chunk.
+func detectProvider(body []byte) string {
+	var shape struct {
+		Object        string          `json:"object"`
+		Type          string          `json:"type"`
+		UsageMetadata json.RawMessage `json:"usageMetadata"`
+		Candidates    json.RawMessage `json:"candidates"`
+	}
+	if json.Unmarshal(body, &shape) != nil {
+		parsed := false
+		for line := range bytes.SplitSeq(body, []byte("\n")) {
+			line = bytes.TrimSpace(line)
+			line = bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:")))
+			if json.Unmarshal(line, &shape) == nil {
+				parsed = true
+				break
+			}
+		}
+		if !parsed {
+			return ""
+		}
+	}
+	switch {
+	case shape.UsageMetadata != nil || shape.Candidates != nil:
+		return "gemini"
+	case shape.Type == "message" || strings.HasPrefix(shape.Type, "message_") || strings.HasPrefix(shape.Type, "content_block_"):
+		return "anthropic"
+	case strings.HasPrefix(shape.Object, "chat.completion"), shape.Object == "text_completion",
+		shape.Object == "response", shape.Object == "list", strings.HasPrefix(shape.Type, "response."):
+		return "openai"
+	}
+	return ""
+}
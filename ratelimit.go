@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimitConfig caps the global request rate with a token bucket.
+type rateLimitConfig struct {
+	// QPS is the sustained rate of requests admitted per second.
+	QPS float64 `json:"qps"`
+	// Burst is the bucket size: how many requests can be admitted at once
+	// after a quiet period. Defaults to QPS rounded up.
+	Burst int `json:"burst,omitempty"`
+}
+
+// rateLimiter is a token bucket shared by every stream, protecting the filter
+// and the upstream from traffic spikes.
+type rateLimiter struct {
+	qps   float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter for cfg, or nil when rate limiting is off.
+func newRateLimiter(cfg *rateLimitConfig) *rateLimiter {
+	if cfg == nil {
+		return nil
+	}
+	return &rateLimiter{
+		qps:    cfg.QPS,
+		burst:  float64(cfg.Burst),
+		tokens: float64(cfg.Burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token if one is available. Otherwise it returns false and how
+// many whole seconds until the next token. A nil limiter admits everything.
+func (l *rateLimiter) allow() (bool, int) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	wait := (1 - l.tokens) / l.qps
+	return false, max(int(math.Ceil(wait)), 1)
+}
+
+func (l *rateLimiter) refill(now time.Time) {
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.qps, l.burst)
+	l.last = now
+}
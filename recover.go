@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// panicRecovery turns a panicking call into an Internal error instead of a
+// crashed process, counting it by kind and logging its first line.
+type panicRecovery struct {
+	panics *prometheus.CounterVec
+}
+
+// panicKind classifies a recovered panic value: nil_deref, index_out_of_range
+// or another runtime error (runtime), or custom for explicit panic calls.
+func panicKind(v any) string {
+	rerr, ok := v.(runtime.Error)
+	if !ok {
+		return "custom"
+	}
+	msg := rerr.Error()
+	switch {
+	case strings.Contains(msg, "nil pointer dereference"):
+		return "nil_deref"
+	case strings.Contains(msg, "index out of range"), strings.Contains(msg, "slice bounds out of range"):
+		return "index_out_of_range"
+	}
+	return "runtime"
+}
+
+// handle is deferred by the interceptors. It recovers a panic of the call
+// and sets *err in its place.
+func (p *panicRecovery) handle(method string, err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	kind := panicKind(v)
+	p.panics.WithLabelValues(kind).Inc()
+	first, _, _ := strings.Cut(fmt.Sprint(v), "\n")
+	panicLog.Errorf("%s panicked (%s): %s", method, kind, first)
+	panicLog.Debugf("%s", debug.Stack())
+	*err = status.Error(codes.Internal, "internal error")
+}
+
+func (p *panicRecovery) unaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer p.handle(info.FullMethod, &err)
+	return handler(ctx, req)
+}
+
+func (p *panicRecovery) streamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer p.handle(info.FullMethod, &err)
+	return handler(srv, ss)
+}
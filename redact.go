@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"google.golang.org/protobuf/proto"
+)
+
+const redactedValue = "[REDACTED]"
+
+// redactPath is a parsed log redaction rule: dot-separated object keys, where
+// * matches any key and a trailing [] descends into every array element, e.g.
+// messages[].content.
+type redactPath []redactStep
+
+type redactStep struct {
+	key  string
+	each bool
+}
+
+func parseRedactPath(rule string) (redactPath, error) {
+	var path redactPath
+	for seg := range strings.SplitSeq(rule, ".") {
+		key, each := strings.CutSuffix(seg, "[]")
+		if key == "" || strings.ContainsAny(key, "[]") {
+			return nil, fmt.Errorf("invalid path segment %q", seg)
+		}
+		path = append(path, redactStep{key: key, each: each})
+	}
+	return path, nil
+}
+
+// apply replaces every value v holds at the path with redactedValue.
+func (p redactPath) apply(v any) {
+	obj, ok := v.(map[string]any)
+	if !ok || len(p) == 0 {
+		return
+	}
+	step, rest := p[0], p[1:]
+	for key, child := range obj {
+		if step.key != "*" && step.key != key {
+			continue
+		}
+		if !step.each {
+			if len(rest) == 0 {
+				obj[key] = redactedValue
+			} else {
+				rest.apply(child)
+			}
+			continue
+		}
+		elems, ok := child.([]any)
+		if !ok {
+			continue
+		}
+		for i := range elems {
+			if len(rest) == 0 {
+				elems[i] = redactedValue
+			} else {
+				rest.apply(elems[i])
+			}
+		}
+	}
+}
+
+// redactor masks the configured fields of bodies before they are logged.
+type redactor struct {
+	paths []redactPath
+}
+
+// newRedactor parses validated redaction rules. It returns nil, which logs
+// bodies as they are, when there are none.
+func newRedactor(rules []string) *redactor {
+	if len(rules) == 0 {
+		return nil
+	}
+	r := &redactor{}
+	for _, rule := range rules {
+		p, _ := parseRedactPath(rule)
+		r.paths = append(r.paths, p)
+	}
+	return r
+}
+
+// body returns body with the configured fields redacted. Bodies that aren't
+// a complete JSON document, such as streamed chunks, can't be inspected and
+// are masked whole, keeping only their size.
+func (r *redactor) body(body []byte) []byte {
+	if len(body) == 0 {
+		return body
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if dec.Decode(&v) != nil || dec.More() {
+		return fmt.Appendf(nil, "[REDACTED %d bytes]", len(body))
+	}
+	for _, p := range r.paths {
+		p.apply(v)
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Appendf(nil, "[REDACTED %d bytes]", len(body))
+	}
+	return out
+}
+
+// loggable returns msg as it may be logged: unchanged without redaction, or
+// a copy with any request, response or mutated body redacted.
+func (r *redactor) loggable(msg proto.Message) proto.Message {
+	if r == nil {
+		return msg
+	}
+	msg = proto.Clone(msg)
+	switch m := msg.(type) {
+	case *extProcPb.ProcessingRequest:
+		if b := m.GetRequestBody(); b != nil {
+			b.Body = r.body(b.Body)
+		}
+		if b := m.GetResponseBody(); b != nil {
+			b.Body = r.body(b.Body)
+		}
+	case *extProcPb.ProcessingResponse:
+		for _, common := range []*extProcPb.CommonResponse{
+			m.GetRequestBody().GetResponse(),
+			m.GetResponseBody().GetResponse(),
+		} {
+			if bm, ok := common.GetBodyMutation().GetMutation().(*extProcPb.BodyMutation_Body); ok {
+				bm.Body = r.body(bm.Body)
+			}
+		}
+	}
+	return msg
+}
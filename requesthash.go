@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+const headerRequestHash = "x-llm-request-hash"
+
+// requestHash returns the hex SHA-256 of the request's model and messages
+// (or prompt, for legacy completions), canonicalized so requests that differ
+// only in whitespace or object key order hash the same. It returns "" for
+// bodies that aren't JSON or carry no messages or prompt.
+func requestHash(body []byte) string {
+	var req struct {
+		Model    string `json:"model"`
+		Messages any    `json:"messages,omitempty"`
+		Prompt   any    `json:"prompt,omitempty"`
+	}
+	// numbers are kept as written rather than round-tripped through float64
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&req); err != nil || (req.Messages == nil && req.Prompt == nil) {
+		return ""
+	}
+	// encoding/json writes compact output with map keys sorted
+	canonical, err := json.Marshal(req)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// retryCostStore accumulates the cost of every attempt at a request, keyed
+// by its request id, so the final attempt can report what the request cost
+// in total, retries included.
+type retryCostStore interface {
+	// add adds an attempt's cost to the request's running total and returns
+	// the new total.
+	add(requestID string, costUSD float64) float64
+}
+
+// memoryRetryCosts is a retryCostStore held in process memory. A request's
+// total is forgotten once no attempt has been added for the window, so
+// attempts must reach the same filter instance within it.
+type memoryRetryCosts struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	totals    map[string]*retryCost
+	lastSweep time.Time
+}
+
+type retryCost struct {
+	usd  float64
+	last time.Time
+}
+
+// newRetryCostStore returns the store for a retry cost window, or nil when
+// accumulation is off.
+func newRetryCostStore(window time.Duration) retryCostStore {
+	if window <= 0 {
+		return nil
+	}
+	return &memoryRetryCosts{
+		window:    window,
+		totals:    make(map[string]*retryCost),
+		lastSweep: time.Now(),
+	}
+}
+
+func (m *memoryRetryCosts) add(requestID string, costUSD float64) float64 {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// expired totals are swept at most once a window, so the map holds
+	// at most about two windows' worth of requests
+	if now.Sub(m.lastSweep) >= m.window {
+		for id, c := range m.totals {
+			if now.Sub(c.last) >= m.window {
+				delete(m.totals, id)
+			}
+		}
+		m.lastSweep = now
+	}
+	c, ok := m.totals[requestID]
+	if !ok || now.Sub(c.last) >= m.window {
+		c = &retryCost{}
+		m.totals[requestID] = c
+	}
+	c.usd += costUSD
+	c.last = now
+	return c.usd
+}
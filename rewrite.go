@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// injectUsage returns body with a "usage" object holding usage appended, for
+// clients that read usage from the body but talk to providers that omit it.
+// The original bytes are preserved so field order and formatting don't
+// change. It returns false if body already has usage or isn't a JSON object.
+func injectUsage(body []byte, usage *tokenUsage) ([]byte, bool, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, false, err
+	}
+	if _, ok := fields["usage"]; ok {
+		return nil, false, nil
+	}
+	injected, err := json.Marshal(struct {
+		PromptTokens     int64 `json:"prompt_tokens"`
+		CompletionTokens int64 `json:"completion_tokens"`
+		TotalTokens      int64 `json:"total_tokens"`
+	}{usage.PromptTokens, usage.CompletionTokens, usage.TotalTokens})
+	if err != nil {
+		return nil, false, err
+	}
+
+	trimmed := bytes.TrimRight(body, " \t\r\n")
+	if len(trimmed) == 0 || trimmed[len(trimmed)-1] != '}' {
+		return nil, false, errors.New("response body is not a JSON object")
+	}
+	var out bytes.Buffer
+	out.Write(trimmed[:len(trimmed)-1])
+	if len(fields) > 0 {
+		out.WriteByte(',')
+	}
+	out.WriteString(`"usage":`)
+	out.Write(injected)
+	out.WriteByte('}')
+	return out.Bytes(), true, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"strings"
+)
+
+// samplingConfig limits usage parsing to a fraction of responses on opt-in
+// routes, trading exact accounting for throughput.
+type samplingConfig struct {
+	// Rate is the fraction of requests, in (0, 1], whose usage is parsed.
+	Rate float64 `json:"rate"`
+	// Paths are request path prefixes sampling applies to. Empty means all.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// sample decides whether a request's usage should be parsed, returning the
+// weight to extrapolate its metrics by. The decision is a hash of the request
+// id so that retries of the same request are treated consistently.
+func (c *samplingConfig) sample(path, requestID string) (float64, bool) {
+	if c == nil || !c.applies(path) {
+		return 1, true
+	}
+	var p float64
+	if requestID == "" {
+		p = rand.Float64()
+	} else {
+		h := fnv.New64a()
+		h.Write([]byte(requestID))
+		p = float64(h.Sum64()) / math.MaxUint64
+	}
+	if p >= c.Rate {
+		return 0, false
+	}
+	return 1 / c.Rate, true
+}
+
+func (c *samplingConfig) applies(path string) bool {
+	if len(c.Paths) == 0 {
+		return true
+	}
+	for _, prefix := range c.Paths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
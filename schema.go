@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// requestSchema validates request bodies on a path prefix against a JSON
+// schema, rejecting malformed requests before they reach the upstream.
+type requestSchema struct {
+	// Path is the request path prefix the schema applies to.
+	Path string `json:"path"`
+	// Schema is the path of the JSON schema file.
+	Schema string `json:"schema"`
+
+	compiled *jsonschema.Schema
+}
+
+// compile loads and compiles the schema file.
+func (r *requestSchema) compile() error {
+	s, err := jsonschema.NewCompiler().Compile(r.Schema)
+	if err != nil {
+		return err
+	}
+	r.compiled = s
+	return nil
+}
+
+// schemaFor returns the first schema whose path prefix matches path, or nil.
+func schemaFor(schemas []requestSchema, path string) *requestSchema {
+	for i := range schemas {
+		if strings.HasPrefix(path, schemas[i].Path) {
+			return &schemas[i]
+		}
+	}
+	return nil
+}
+
+// validate checks body against the schema, returning an error describing
+// every violation. The error is returned to the client, so it leaves out the
+// schema's location.
+func (r *requestSchema) validate(body []byte) error {
+	inst, err := jsonschema.UnmarshalJSON(bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("request body is not valid JSON: %w", err)
+	}
+	if err := r.compiled.Validate(inst); err != nil {
+		// the first line names the schema file; the rest list the violations
+		_, violations, _ := strings.Cut(err.Error(), "\n")
+		return fmt.Errorf("request body does not match schema:\n%s", violations)
+	}
+	return nil
+}
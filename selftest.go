@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+)
+
+// selfTestFixtures holds a response body, <parser>.body, and the usage it
+// must parse to, <parser>.usage.json, for every registered parser.
+//
+//go:embed selftest
+var selfTestFixtures embed.FS
+
+const (
+	selfTestWarn = "warn"
+	selfTestFail = "fail"
+)
+
+// selfTestParsers runs every registered parser against its embedded fixture,
+// returning an error for each parser that is missing a fixture or no longer
+// parses it to the expected usage.
+func selfTestParsers() []error {
+	var errs []error
+	for _, p := range parsers {
+		body, err := selfTestFixtures.ReadFile("selftest/" + p.Name + ".body")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("parser %s: no fixture: %w", p.Name, err))
+			continue
+		}
+		want, err := selfTestFixtures.ReadFile("selftest/" + p.Name + ".usage.json")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("parser %s: no expected usage: %w", p.Name, err))
+			continue
+		}
+		usage, err := p.parse(body)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("parser %s: %w", p.Name, err))
+			continue
+		}
+		// compare as JSON, so fields the fixture leaves out must be zero
+		got, err := json.Marshal(usage)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("parser %s: %w", p.Name, err))
+			continue
+		}
+		var expected tokenUsage
+		if err := json.Unmarshal(want, &expected); err != nil {
+			errs = append(errs, fmt.Errorf("parser %s: invalid expected usage: %w", p.Name, err))
+			continue
+		}
+		if wantJSON, _ := json.Marshal(expected); !bytes.Equal(got, wantJSON) {
+			errs = append(errs, fmt.Errorf("parser %s: got usage %s, want %s", p.Name, got, wantJSON))
+		}
+	}
+	return errs
+}
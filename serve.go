@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// serveWithRestarts serves s on lis and, if serving fails for any reason other
+// than shutdown, re-binds with listen and serves again up to maxRestarts times
+// with exponential backoff. It returns nil once the server stops for shutdown,
+// or the last error when restarts are exhausted.
+func serveWithRestarts(s *grpc.Server, lis net.Listener, listen func() (net.Listener, error), maxRestarts int, stopping *atomic.Bool) error {
+	backoff := time.Second
+	for restarts := 0; ; restarts++ {
+		var err error
+		if lis == nil {
+			lis, err = listen()
+		}
+		if err == nil {
+			err = s.Serve(lis)
+			lis = nil
+		}
+		if stopping.Load() || errors.Is(err, grpc.ErrServerStopped) {
+			return nil
+		}
+		if restarts >= maxRestarts {
+			return err
+		}
+		mainLog.Errorf("gRPC server failed: %v, restarting in %s (%d/%d)", err, backoff, restarts+1, maxRestarts)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// stopGracefully stops s, letting in-flight streams finish for up to timeout
+// before the rest are cancelled.
+func stopGracefully(s *grpc.Server, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		mainLog.Warnf("In-flight streams still open after %s, stopping", timeout)
+		s.Stop()
+		<-done
+	}
+}
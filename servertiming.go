@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// maxServerTimingMetrics caps distinct Server-Timing metric names recorded as
+// labels, since they are chosen by the upstream.
+const maxServerTimingMetrics = 20
+
+// serverTiming is one metric of an upstream Server-Timing header.
+type serverTiming struct {
+	Name       string
+	DurationMS float64
+}
+
+// parseServerTiming returns the metrics of a Server-Timing header that carry a
+// duration, e.g. `queue;dur=12, inference;dur=350.5;desc="gpu"`. Malformed
+// entries and entries without a dur are skipped.
+func parseServerTiming(header string) []serverTiming {
+	var timings []serverTiming
+	for _, entry := range strings.Split(header, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		params := strings.Split(entry, ";")
+		name := normalizeTimingName(params[0])
+		if name == "" {
+			continue
+		}
+		for _, p := range params[1:] {
+			k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(k), "dur") {
+				continue
+			}
+			dur, err := strconv.ParseFloat(strings.Trim(strings.TrimSpace(v), `"`), 64)
+			if err != nil || dur < 0 {
+				break
+			}
+			timings = append(timings, serverTiming{Name: name, DurationMS: dur})
+			break
+		}
+	}
+	return timings
+}
+
+// normalizeTimingName lowercases a metric name and keeps only characters that
+// are safe in a header name, or returns "" if nothing is left.
+func normalizeTimingName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r == '_' || r == '.':
+			return '-'
+		}
+		return -1
+	}, name)
+}
+
+// serverTimingHeader is the response header a Server-Timing metric is
+// re-exposed as.
+func serverTimingHeader(name string) string {
+	return "x-llm-upstream-" + name + "-ms"
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseServerTiming(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   []serverTiming
+	}{
+		{
+			name:   "multiple",
+			header: `queue;dur=12, inference;dur=350.5;desc="gpu"`,
+			want:   []serverTiming{{Name: "queue", DurationMS: 12}, {Name: "inference", DurationMS: 350.5}},
+		},
+		{
+			name:   "empty entries and padding",
+			header: ` , queue ; dur = 12 ,, ,inference;dur="7"`,
+			want:   []serverTiming{{Name: "queue", DurationMS: 12}, {Name: "inference", DurationMS: 7}},
+		},
+		{
+			name:   "malformed",
+			header: `queue;dur=abc, cache;desc=hit, ;dur=3, db.read;dur=-1`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseServerTiming(tt.header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsComputedHeader(t *testing.T) {
+	for name, want := range map[string]bool{
+		headerCostUSD:                 true,
+		"X-LLM-Upstream-Inference-Ms": true,
+		serverTimingHeader("queue"):   true,
+		"x-llm-team":                  false,
+		"x-upstream-inference-ms":     false,
+	} {
+		if got := isComputedHeader(name); got != want {
+			t.Errorf("isComputedHeader(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
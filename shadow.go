@@ -0,0 +1,28 @@
+package main
+
+import (
+	"reflect"
+)
+
+// shadowParse runs the configured candidate parser on body and records whether
+// it agrees with the default parser's result. It never affects the response,
+// letting new parsers be validated against production traffic.
+func (s *server) shadowParse(body []byte, usage *tokenUsage, err error) {
+	candidate, candidateErr := lookupParser(s.shadowParser).parse(body)
+
+	match := false
+	switch {
+	case err != nil || candidateErr != nil:
+		match = err != nil && candidateErr != nil
+	default:
+		match = reflect.DeepEqual(usage, candidate)
+	}
+
+	if match {
+		s.metrics.shadowParses.WithLabelValues(s.shadowParser, "match").Inc()
+		return
+	}
+	s.metrics.shadowParses.WithLabelValues(s.shadowParser, "mismatch").Inc()
+	shadowLog.Warnf("Parser %q disagrees with default: default=%+v (err %v), candidate=%+v (err %v)",
+		s.shadowParser, usage, err, candidate, candidateErr)
+}
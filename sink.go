@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sink is a destination for usage events. Record must not block for long; it
+// is called from the shared worker pool, never from the request path.
+type sink interface {
+	Record(ev usageEvent)
+	Close() error
+}
+
+// workerPool runs jobs on a fixed set of goroutines behind a bounded queue.
+type workerPool struct {
+	jobs chan func()
+	wg   sync.WaitGroup
+
+	// mu guards closed, so a stream still recording usage after a forced
+	// shutdown doesn't send on the closed jobs channel
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newWorkerPool(workers, queueSize int) *workerPool {
+	p := &workerPool{jobs: make(chan func(), queueSize)}
+	for range workers {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues job without blocking, returning false if the queue is full
+// or the pool has stopped.
+func (p *workerPool) submit(job func()) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return false
+	}
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop waits for queued jobs to finish and stops the workers.
+func (p *workerPool) stop() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// multiSink fans each usage event out to every configured sink through the
+// worker pool, so a slow or failing sink never holds up the others or the
+// request path.
+type multiSink struct {
+	names   []string
+	sinks   []sink
+	pool    *workerPool
+	dropped *prometheus.CounterVec
+}
+
+// newSinks constructs the sinks enabled in cfg.
+func newSinks(cfg *config, metrics *metrics) (*multiSink, error) {
+	m := &multiSink{
+		pool:    newWorkerPool(cfg.SinkWorkers, cfg.SinkQueueSize),
+		dropped: metrics.sinkDropped,
+	}
+	if cfg.Syslog != nil {
+		s, err := newSyslogSink(cfg.Syslog)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("syslog sink: %w", err)
+		}
+		m.add("syslog", s)
+	}
+	if cfg.Webhook != nil {
+		m.add("webhook", newWebhookSink(cfg.Webhook, cfg.SinkQueueSize, metrics.sinkDeadLetters.WithLabelValues("webhook")))
+	}
+	if cfg.DogStatsD != nil {
+		s, err := newDogStatsDSink(cfg.DogStatsD)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("dogstatsd sink: %w", err)
+		}
+		m.add("dogstatsd", s)
+	}
+	if cfg.GRPCSink != nil {
+		s, err := newGRPCSink(cfg.GRPCSink)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("grpc sink: %w", err)
+		}
+		m.add("grpc", s)
+	}
+	if cfg.OTLP != nil {
+		s, err := newOTLPSink(cfg.OTLP, cfg.MaxModelLabels)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("otlp sink: %w", err)
+		}
+		m.add("otlp", s)
+	}
+	if cfg.CloudWatchEMF != nil {
+		var f *os.File
+		if path := cfg.CloudWatchEMF.Path; path != "" {
+			var err error
+			if f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644); err != nil {
+				m.Close()
+				return nil, fmt.Errorf("cloudwatch_emf sink: %w", err)
+			}
+		}
+		m.add("cloudwatch", newCloudWatchSink(cfg.CloudWatchEMF, f))
+	}
+	if cfg.SQLite != nil {
+		s, err := newSQLiteSink(cfg.SQLite.Path, time.Duration(cfg.SQLite.FlushInterval))
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("sqlite sink: %w", err)
+		}
+		m.add("sqlite", s)
+	}
+	return m, nil
+}
+
+func (m *multiSink) add(name string, s sink) {
+	sinksLog.Infof("Registered %s usage sink", name)
+	m.names = append(m.names, name)
+	m.sinks = append(m.sinks, s)
+}
+
+// Record hands ev to each sink on the worker pool. Events are dropped, and
+// counted, when the pool's queue is full. It returns false if any sink's
+// event was dropped.
+func (m *multiSink) Record(ev usageEvent) bool {
+	ok := true
+	for i, s := range m.sinks {
+		if !m.pool.submit(func() { s.Record(ev) }) {
+			m.dropped.WithLabelValues(m.names[i]).Inc()
+			ok = false
+		}
+	}
+	return ok
+}
+
+// Close drains the worker pool and closes every sink.
+func (m *multiSink) Close() error {
+	m.pool.stop()
+	var errs []error
+	for i, s := range m.sinks {
+		if err := s.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", m.names[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
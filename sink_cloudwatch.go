@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+)
+
+// cloudWatchFields are the usage event fields the CloudWatch sink can emit as
+// metrics, with their CloudWatch units.
+var cloudWatchFields = map[string]string{
+	"prompt_tokens":      "Count",
+	"completion_tokens":  "Count",
+	"total_tokens":       "Count",
+	"reasoning_tokens":   "Count",
+	"cache_read_tokens":  "Count",
+	"cache_write_tokens": "Count",
+	"cost_usd":           "None",
+}
+
+// cloudWatchDimensions are the usage event fields metrics can be split by.
+var cloudWatchDimensions = []string{"model", "tenant", "environment"}
+
+var defaultCloudWatchMetrics = map[string]string{
+	"prompt_tokens":     "PromptTokens",
+	"completion_tokens": "CompletionTokens",
+	"total_tokens":      "TotalTokens",
+	"cost_usd":          "CostUSD",
+}
+
+// cloudWatchSink writes usage events to stdout, or a file, in CloudWatch
+// embedded metric format (EMF), which the CloudWatch agent or Lambda/ECS/EKS log drivers turn
+// into metrics without a Prometheus scraper.
+type cloudWatchSink struct {
+	namespace  string
+	dimensions []string
+	// fields are the metric fields in a stable order, and names their
+	// CloudWatch metric names.
+	fields []string
+	names  map[string]string
+
+	mu  sync.Mutex
+	enc *json.Encoder
+	// file is the file written to in place of stdout, if any.
+	file *os.File
+}
+
+// newCloudWatchSink writes to file, which it closes on Close, or to stdout
+// when file is nil.
+func newCloudWatchSink(cfg *cloudWatchConfig, file *os.File) *cloudWatchSink {
+	var w io.Writer = os.Stdout
+	if file != nil {
+		w = file
+	}
+	return &cloudWatchSink{
+		namespace:  cfg.Namespace,
+		dimensions: cfg.Dimensions,
+		fields:     slices.Sorted(maps.Keys(cfg.MetricNames)),
+		names:      cfg.MetricNames,
+		enc:        json.NewEncoder(w),
+		file:       file,
+	}
+}
+
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+// Record writes ev as one EMF line. Dimensions the event has no value for
+// are left out, since CloudWatch rejects empty dimension values.
+func (s *cloudWatchSink) Record(ev usageEvent) {
+	values := map[string]string{
+		"model":       ev.Model,
+		"tenant":      ev.Tenant,
+		"environment": ev.Environment,
+	}
+	numbers := map[string]any{
+		"prompt_tokens":      ev.PromptTokens,
+		"completion_tokens":  ev.CompletionTokens,
+		"total_tokens":       ev.TotalTokens,
+		"reasoning_tokens":   ev.ReasoningTokens,
+		"cache_read_tokens":  ev.CacheReadTokens,
+		"cache_write_tokens": ev.CacheWriteTokens,
+		"cost_usd":           ev.CostUSD,
+	}
+	line := map[string]any{}
+	dims := []string{}
+	for _, d := range s.dimensions {
+		if v := values[d]; v != "" {
+			dims = append(dims, d)
+			line[d] = v
+		}
+	}
+	directive := emfDirective{Namespace: s.namespace, Dimensions: [][]string{dims}}
+	for _, f := range s.fields {
+		// cost is meaningless for unpriced models
+		if f == "cost_usd" && !ev.priced {
+			continue
+		}
+		directive.Metrics = append(directive.Metrics, emfMetric{Name: s.names[f], Unit: cloudWatchFields[f]})
+		line[s.names[f]] = numbers[f]
+	}
+	if ev.RequestID != "" {
+		line["request_id"] = ev.RequestID
+	}
+	line["_aws"] = emfMetadata{
+		Timestamp:         ev.Timestamp.UnixMilli(),
+		CloudWatchMetrics: []emfDirective{directive},
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(line); err != nil {
+		cloudWatchLog.Errorf("Failed to write usage event: %v", err)
+	}
+}
+
+func (s *cloudWatchSink) Close() error {
+	if s.file != nil {
+		return s.file.Close()
+	}
+	return nil
+}
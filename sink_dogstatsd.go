@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dogStatsDTags are the usage event fields the DogStatsD sink can tag by.
+var dogStatsDTags = []string{"model", "provider", "tenant", "environment"}
+
+// dogStatsDFlushInterval bounds how long a metric waits in a partly filled
+// packet.
+const dogStatsDFlushInterval = time.Second
+
+// dogStatsDSink sends usage to a Datadog agent over DogStatsD: llm.tokens
+// counts by token type, the llm.request.tokens histogram and, for priced
+// models, the llm.cost count. Metrics are packed into packets of up to
+// maxPacket bytes, sent when full and at least every second.
+type dogStatsDSink struct {
+	tags         []string
+	constantTags string
+	maxPacket    int
+
+	mu   sync.Mutex
+	conn net.Conn
+	buf  bytes.Buffer
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newDogStatsDSink(cfg *dogStatsDConfig) (*dogStatsDSink, error) {
+	// UDP dials don't contact the agent, so this only fails on a bad address
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	s := &dogStatsDSink{
+		tags:         cfg.Tags,
+		constantTags: strings.Join(cfg.ConstantTags, ","),
+		maxPacket:    cfg.MaxPacketSize,
+		conn:         conn,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		t := time.NewTicker(dogStatsDFlushInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.mu.Lock()
+				s.flush()
+				s.mu.Unlock()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+// dogStatsDTagValue makes v safe as a tag value: the protocol separates tags
+// with commas and fields with pipes, and Datadog lowercases tags anyway.
+func dogStatsDTagValue(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ',', '|', '#', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, strings.ToLower(v))
+}
+
+func (s *dogStatsDSink) Record(ev usageEvent) {
+	values := map[string]string{
+		"model":       ev.Model,
+		"provider":    ev.Provider,
+		"tenant":      ev.Tenant,
+		"environment": ev.Environment,
+	}
+	tags := []string{}
+	if s.constantTags != "" {
+		tags = append(tags, s.constantTags)
+	}
+	for _, t := range s.tags {
+		if v := values[t]; v != "" {
+			tags = append(tags, t+":"+dogStatsDTagValue(v))
+		}
+	}
+	tagged := func(extra ...string) string {
+		if all := append(extra, tags...); len(all) > 0 {
+			return "|#" + strings.Join(all, ",")
+		}
+		return ""
+	}
+	lines := []string{
+		"llm.tokens:" + strconv.FormatInt(ev.PromptTokens, 10) + "|c" + tagged("type:prompt"),
+		"llm.tokens:" + strconv.FormatInt(ev.CompletionTokens, 10) + "|c" + tagged("type:completion"),
+		"llm.request.tokens:" + strconv.FormatInt(ev.TotalTokens, 10) + "|h" + tagged(),
+	}
+	// cost is meaningless for unpriced models
+	if ev.priced {
+		lines = append(lines, "llm.cost:"+strconv.FormatFloat(ev.CostUSD, 'f', -1, 64)+"|c"+tagged())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, line := range lines {
+		if s.buf.Len() > 0 && s.buf.Len()+1+len(line) > s.maxPacket {
+			s.flush()
+		}
+		if s.buf.Len() > 0 {
+			s.buf.WriteByte('\n')
+		}
+		s.buf.WriteString(line)
+	}
+}
+
+// flush sends the buffered metrics as one packet. s.mu must be held.
+func (s *dogStatsDSink) flush() {
+	if s.buf.Len() == 0 {
+		return
+	}
+	if _, err := s.conn.Write(s.buf.Bytes()); err != nil {
+		dogStatsDLog.Warnf("Failed to send metrics: %v", err)
+	}
+	s.buf.Reset()
+}
+
+// Close sends any buffered metrics.
+func (s *dogStatsDSink) Close() error {
+	close(s.stop)
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush()
+	return s.conn.Close()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// defaultGRPCSinkMethod is the method usage events are sent to, from the
+// service
+//
+//	package tokenextproc.v1;
+//	service UsageSink {
+//	  rpc Record(google.protobuf.Struct) returns (google.protobuf.Empty);
+//	}
+//
+// whose request is the usage event as it is encoded to JSON. Built only on
+// well-known types, it needs no generated code on either side.
+const defaultGRPCSinkMethod = "/tokenextproc.v1.UsageSink/Record"
+
+// grpcSink forwards usage events to another gRPC service, such as a
+// downstream processor in a chain. The connection reconnects by itself
+// after failures; events sent while it is down fail and are logged.
+type grpcSink struct {
+	conn    *grpc.ClientConn
+	method  string
+	timeout time.Duration
+}
+
+func newGRPCSink(cfg *grpcSinkConfig) (*grpcSink, error) {
+	creds := insecure.NewCredentials()
+	if cfg.TLS {
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	// NewClient connects lazily, so an unreachable endpoint doesn't fail
+	// startup
+	conn, err := grpc.NewClient(cfg.Address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	return &grpcSink{conn: conn, method: cfg.Method, timeout: time.Duration(cfg.Timeout)}, nil
+}
+
+// Record sends ev as a Struct. It runs on the sink worker pool, never on the
+// request path.
+func (s *grpcSink) Record(ev usageEvent) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		grpcSinkLog.Errorf("Failed to encode usage event: %v", err)
+		return
+	}
+	msg := &structpb.Struct{}
+	if err := msg.UnmarshalJSON(b); err != nil {
+		grpcSinkLog.Errorf("Failed to encode usage event: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	if err := s.conn.Invoke(ctx, s.method, msg, &emptypb.Empty{}); err != nil {
+		grpcSinkLog.Warnf("Failed to forward usage event %s: %v", ev.RequestID, err)
+	}
+}
+
+func (s *grpcSink) Close() error {
+	return s.conn.Close()
+}
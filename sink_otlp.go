@@ -0,0 +1,268 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// otlpExportMethod is the OTLP/gRPC metrics export method.
+const otlpExportMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// otlpSink accumulates token and cost totals from usage events and exports
+// them to an OTLP/gRPC collector every interval, as cumulative sums. The
+// request is encoded by hand with protowire rather than with the OTLP
+// generated code or the OTel SDK, keeping both out of the binary.
+type otlpSink struct {
+	conn     *grpc.ClientConn
+	headers  metadata.MD
+	timeout  time.Duration
+	resource []byte
+	start    time.Time
+
+	// model and tenant come from request bodies and headers, so they are
+	// capped like metric labels to bound the series kept in memory
+	models  *labelCapper
+	tenants *labelCapper
+
+	mu     sync.Mutex
+	tokens map[otlpSeries]int64
+	cost   map[otlpSeries]float64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// otlpSeries is the attributes of one data point. Cost points leave
+// tokenType empty.
+type otlpSeries struct {
+	model, provider, tenant, tokenType string
+}
+
+func newOTLPSink(cfg *otlpConfig, maxModels int) (*otlpSink, error) {
+	creds := insecure.NewCredentials()
+	if cfg.TLS {
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	conn, err := grpc.NewClient(cfg.Endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	s := &otlpSink{
+		conn:     conn,
+		headers:  metadata.New(cfg.Headers),
+		timeout:  time.Duration(cfg.Timeout),
+		resource: otlpResource(cfg.ResourceAttributes),
+		start:    time.Now(),
+		models:   newLabelCapper(maxModels),
+		tenants:  newLabelCapper(defaultLabelMaxValues),
+		tokens:   make(map[otlpSeries]int64),
+		cost:     make(map[otlpSeries]float64),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		t := time.NewTicker(time.Duration(cfg.Interval))
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.export()
+			case <-s.stop:
+				s.export()
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (s *otlpSink) Record(ev usageEvent) {
+	series := otlpSeries{model: s.models.value(ev.Model), provider: ev.Provider, tenant: ev.Tenant}
+	if ev.Tenant != "" {
+		series.tenant = s.tenants.value(ev.Tenant)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	series.tokenType = "prompt"
+	s.tokens[series] += ev.PromptTokens
+	series.tokenType = "completion"
+	s.tokens[series] += ev.CompletionTokens
+	// cost is meaningless for unpriced models
+	if ev.priced {
+		series.tokenType = ""
+		s.cost[series] += ev.CostUSD
+	}
+}
+
+// export sends the totals so far. Failures are logged and the totals kept,
+// so the next export, being cumulative, makes up for them.
+func (s *otlpSink) export() {
+	s.mu.Lock()
+	if len(s.tokens) == 0 && len(s.cost) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	req := s.request(time.Now())
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(context.Background(), s.headers), s.timeout)
+	defer cancel()
+	var resp []byte
+	if err := s.conn.Invoke(ctx, otlpExportMethod, req, &resp, grpc.ForceCodec(rawCodec{})); err != nil {
+		otlpLog.Warnf("Failed to export metrics: %v", err)
+	}
+}
+
+// request encodes an ExportMetricsServiceRequest holding the llm.tokens and
+// llm.cost sums. s.mu must be held.
+func (s *otlpSink) request(now time.Time) []byte {
+	start, end := uint64(s.start.UnixNano()), uint64(now.UnixNano())
+	point := func(series otlpSeries, value func([]byte) []byte) []byte {
+		var p []byte
+		p = protowire.AppendTag(p, 2, protowire.Fixed64Type) // start_time_unix_nano
+		p = protowire.AppendFixed64(p, start)
+		p = protowire.AppendTag(p, 3, protowire.Fixed64Type) // time_unix_nano
+		p = protowire.AppendFixed64(p, end)
+		p = value(p)
+		for _, kv := range [][2]string{{"model", series.model}, {"provider", series.provider}, {"tenant", series.tenant}, {"type", series.tokenType}} {
+			if kv[1] != "" {
+				p = protowire.AppendTag(p, 7, protowire.BytesType) // attributes
+				p = protowire.AppendBytes(p, otlpKeyValue(kv[0], kv[1]))
+			}
+		}
+		return p
+	}
+	var tokenPoints, costPoints [][]byte
+	for _, series := range slices.SortedFunc(maps.Keys(s.tokens), compareOTLPSeries) {
+		tokenPoints = append(tokenPoints, point(series, func(p []byte) []byte {
+			p = protowire.AppendTag(p, 6, protowire.Fixed64Type) // as_int
+			return protowire.AppendFixed64(p, uint64(s.tokens[series]))
+		}))
+	}
+	for _, series := range slices.SortedFunc(maps.Keys(s.cost), compareOTLPSeries) {
+		costPoints = append(costPoints, point(series, func(p []byte) []byte {
+			p = protowire.AppendTag(p, 4, protowire.Fixed64Type) // as_double
+			return protowire.AppendFixed64(p, math.Float64bits(s.cost[series]))
+		}))
+	}
+
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType) // scope
+	scope = protowire.AppendBytes(scope, protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), []byte("token-ext-proc")))
+	for _, m := range [][]byte{
+		otlpSum("llm.tokens", "Tokens by type (prompt|completion).", "{token}", tokenPoints),
+		otlpSum("llm.cost", "Cost of priced requests.", "USD", costPoints),
+	} {
+		if m != nil {
+			scope = protowire.AppendTag(scope, 2, protowire.BytesType) // metrics
+			scope = protowire.AppendBytes(scope, m)
+		}
+	}
+
+	var rm []byte
+	rm = protowire.AppendTag(rm, 1, protowire.BytesType) // resource
+	rm = protowire.AppendBytes(rm, s.resource)
+	rm = protowire.AppendTag(rm, 2, protowire.BytesType) // scope_metrics
+	rm = protowire.AppendBytes(rm, scope)
+
+	req := protowire.AppendTag(nil, 1, protowire.BytesType) // resource_metrics
+	return protowire.AppendBytes(req, rm)
+}
+
+func compareOTLPSeries(a, b otlpSeries) int {
+	return cmp.Or(cmp.Compare(a.model, b.model), cmp.Compare(a.provider, b.provider),
+		cmp.Compare(a.tenant, b.tenant), cmp.Compare(a.tokenType, b.tokenType))
+}
+
+// otlpSum encodes a Metric holding a cumulative monotonic Sum, or returns
+// nil when it has no points.
+func otlpSum(name, description, unit string, points [][]byte) []byte {
+	if len(points) == 0 {
+		return nil
+	}
+	var sum []byte
+	for _, p := range points {
+		sum = protowire.AppendTag(sum, 1, protowire.BytesType) // data_points
+		sum = protowire.AppendBytes(sum, p)
+	}
+	sum = protowire.AppendTag(sum, 2, protowire.VarintType) // aggregation_temporality
+	sum = protowire.AppendVarint(sum, 2)                    // CUMULATIVE
+	sum = protowire.AppendTag(sum, 3, protowire.VarintType) // is_monotonic
+	sum = protowire.AppendVarint(sum, 1)
+
+	var m []byte
+	m = protowire.AppendTag(m, 1, protowire.BytesType)
+	m = protowire.AppendString(m, name)
+	m = protowire.AppendTag(m, 2, protowire.BytesType)
+	m = protowire.AppendString(m, description)
+	m = protowire.AppendTag(m, 3, protowire.BytesType)
+	m = protowire.AppendString(m, unit)
+	m = protowire.AppendTag(m, 7, protowire.BytesType) // sum
+	return protowire.AppendBytes(m, sum)
+}
+
+// otlpKeyValue encodes a KeyValue with a string value.
+func otlpKeyValue(key, value string) []byte {
+	var v []byte
+	v = protowire.AppendTag(v, 1, protowire.BytesType) // string_value
+	v = protowire.AppendString(v, value)
+	var kv []byte
+	kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+	kv = protowire.AppendString(kv, key)
+	kv = protowire.AppendTag(kv, 2, protowire.BytesType)
+	return protowire.AppendBytes(kv, v)
+}
+
+// otlpResource encodes a Resource with the given attributes.
+func otlpResource(attrs map[string]string) []byte {
+	var r []byte
+	for _, k := range slices.Sorted(maps.Keys(attrs)) {
+		r = protowire.AppendTag(r, 1, protowire.BytesType)
+		r = protowire.AppendBytes(r, otlpKeyValue(k, attrs[k]))
+	}
+	return r
+}
+
+// Close exports the final totals.
+func (s *otlpSink) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.conn.Close()
+}
+
+// rawCodec passes messages through as already encoded bytes, for calls made
+// without generated message types.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("rawCodec: cannot marshal %T", v)
+	}
+	return b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("rawCodec: cannot unmarshal into %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string { return "proto" }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOTLPSinkCapsSeries(t *testing.T) {
+	s, err := newOTLPSink(&otlpConfig{Endpoint: "127.0.0.1:1", Interval: duration(time.Hour), Timeout: duration(time.Second)}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	for i := range 5 {
+		s.Record(usageEvent{Model: fmt.Sprintf("model-%d", i), Tenant: fmt.Sprintf("tenant-%d", i), tokenUsage: tokenUsage{PromptTokens: 1, CompletionTokens: 1}})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// two models keep their own series and the rest share "other", each with
+	// a prompt and a completion point
+	models := map[string]int64{}
+	for series, n := range s.tokens {
+		models[series.model] += n
+	}
+	want := map[string]int64{"model-0": 2, "model-1": 2, overflowLabel: 6}
+	if fmt.Sprint(models) != fmt.Sprint(want) {
+		t.Errorf("tokens by model = %v, want %v", models, want)
+	}
+}
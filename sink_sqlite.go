@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const createUsageTable = `CREATE TABLE IF NOT EXISTS usage_events (
+	timestamp         TEXT NOT NULL,
+	environment       TEXT,
+	model             TEXT,
+	tenant            TEXT,
+	prompt_tokens     INTEGER NOT NULL,
+	completion_tokens INTEGER NOT NULL,
+	total_tokens      INTEGER NOT NULL,
+	cost_usd          REAL NOT NULL
+)`
+
+// sqliteSink persists usage events to a local SQLite database, giving
+// air-gapped deployments an audit trail without Kafka or Prometheus. Events are
+// buffered in memory and inserted in batches so the request path never waits
+// on disk.
+type sqliteSink struct {
+	db *sql.DB
+
+	mu      sync.Mutex
+	pending []usageEvent
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newSQLiteSink(path string, flushInterval time.Duration) (*sqliteSink, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("opening sqlite database: %w", err)
+	}
+	if _, err := db.Exec(createUsageTable); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating usage_events table: %w", err)
+	}
+	s := &sqliteSink{
+		db:   db,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.run(flushInterval)
+	return s, nil
+}
+
+// Record queues ev for the next batch insert.
+func (s *sqliteSink) Record(ev usageEvent) {
+	s.mu.Lock()
+	s.pending = append(s.pending, ev)
+	s.mu.Unlock()
+}
+
+// Close flushes any pending events and closes the database.
+func (s *sqliteSink) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.db.Close()
+}
+
+func (s *sqliteSink) run(flushInterval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+func (s *sqliteSink) flush() {
+	s.mu.Lock()
+	batch := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	if err := s.insert(batch); err != nil {
+		sqliteLog.Errorf("Failed to insert %d usage events: %v", len(batch), err)
+	}
+}
+
+func (s *sqliteSink) insert(batch []usageEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO usage_events
+		(timestamp, environment, model, tenant, prompt_tokens, completion_tokens, total_tokens, cost_usd)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, ev := range batch {
+		if _, err := stmt.Exec(ev.Timestamp.UTC().Format(time.RFC3339Nano), ev.Environment, ev.Model, ev.Tenant,
+			ev.PromptTokens, ev.CompletionTokens, ev.TotalTokens, ev.CostUSD); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
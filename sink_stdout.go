@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// stdoutSink writes each usage event as a compact JSON line, for log agents
+// tailing the container's stdout. Logs go to stderr, so the stream holds
+// nothing but events.
+type stdoutSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newStdoutSink(w io.Writer) *stdoutSink {
+	return &stdoutSink{enc: json.NewEncoder(w)}
+}
+
+// Record writes ev as one line. Workers call it concurrently, so writes are
+// serialised to keep lines whole.
+func (s *stdoutSink) Record(ev usageEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(ev); err != nil {
+		stdoutLog.Errorf("Failed to write usage event: %v", err)
+	}
+}
+
+func (s *stdoutSink) Close() error {
+	return nil
+}
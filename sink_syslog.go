@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3,
+	"warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// syslogSDID is the structured data id usage is sent under in kv format. 32473
+// is the private enterprise number reserved for documentation.
+const syslogSDID = "usage@32473"
+
+// syslogSink sends usage events to a remote syslog server as RFC 5424
+// messages, for environments whose SIEM pipelines are built on syslog.
+type syslogSink struct {
+	network string
+	address string
+	format  string
+	pri     int
+
+	hostname string
+	procID   string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newSyslogSink(cfg *syslogConfig) (*syslogSink, error) {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	s := &syslogSink{
+		network:  cfg.Network,
+		address:  cfg.Address,
+		format:   cfg.Format,
+		pri:      syslogFacilities[cfg.Facility]*8 + syslogSeverities[cfg.Severity],
+		hostname: hostname,
+		procID:   strconv.Itoa(os.Getpid()),
+	}
+	if err := s.dial(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *syslogSink) dial() error {
+	conn, err := net.DialTimeout(s.network, s.address, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("connecting to %s %s: %w", s.network, s.address, err)
+	}
+	s.conn = conn
+	return nil
+}
+
+// Record sends ev, reconnecting once if the connection has failed.
+func (s *syslogSink) Record(ev usageEvent) {
+	msg, err := s.message(ev)
+	if err != nil {
+		syslogLog.Errorf("Failed to format usage event: %v", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil || s.write(msg) != nil {
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+		if err := s.dial(); err != nil {
+			syslogLog.Warnf("Dropping usage event: %v", err)
+			return
+		}
+		if err := s.write(msg); err != nil {
+			syslogLog.Errorf("Failed to send usage event: %v", err)
+		}
+	}
+}
+
+// write sends one message. Stream transports use octet-counting framing
+// (RFC 6587); datagrams carry one message each.
+func (s *syslogSink) write(msg []byte) error {
+	if s.network != "udp" {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := s.conn.Write(msg)
+	return err
+}
+
+// message formats ev as an RFC 5424 message: in json format the event is the
+// message body, in kv format its fields are structured data parameters.
+func (s *syslogSink) message(ev usageEvent) ([]byte, error) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%d>1 %s %s token-ext-proc %s usage ",
+		s.pri, ev.Timestamp.UTC().Format(time.RFC3339Nano), s.hostname, s.procID)
+	if s.format == "json" {
+		buf.WriteString("- ")
+		buf.Write(body)
+		return buf.Bytes(), nil
+	}
+	var fields map[string]any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		return nil, err
+	}
+	buf.WriteString("[" + syslogSDID)
+	for _, k := range slices.Sorted(maps.Keys(fields)) {
+		fmt.Fprintf(&buf, ` %s="%s"`, k, sdEscaper.Replace(fmt.Sprint(fields[k])))
+	}
+	buf.WriteString("]")
+	return buf.Bytes(), nil
+}
+
+// sdEscaper escapes structured data parameter values (RFC 5424 section 6.3.3).
+var sdEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+func (s *syslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestWorkerPoolSubmitAfterStop(t *testing.T) {
+	p := newWorkerPool(2, 8)
+	// streams still recording usage while the pool stops must not panic
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				p.submit(func() {})
+			}
+		}()
+	}
+	p.stop()
+	wg.Wait()
+	if p.submit(func() {}) {
+		t.Error("submit after stop = true, want false")
+	}
+	p.stop()
+}
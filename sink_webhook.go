@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// headerWebhookSignature carries the payload's HMAC-SHA256 when a secret is
+// configured, in the sha256=<hex> form GitHub webhooks use.
+const headerWebhookSignature = "X-Signature-256"
+
+// webhookSink POSTs each usage event as JSON to a URL, retrying failed
+// deliveries with backoff. Events that still fail are dead-lettered: logged
+// and counted, not kept.
+type webhookSink struct {
+	url         string
+	client      *http.Client
+	maxAttempts int
+	secret      []byte
+	// deliveries runs deliveries and their retries on the webhook's own
+	// workers, one per concurrent delivery, so a slow receiver backs up
+	// this queue rather than the shared pool's workers.
+	deliveries  *workerPool
+	deadLetters prometheus.Counter
+}
+
+func newWebhookSink(cfg *webhookConfig, queueSize int, deadLetters prometheus.Counter) *webhookSink {
+	return &webhookSink{
+		url:         cfg.URL,
+		client:      &http.Client{Timeout: time.Duration(cfg.Timeout)},
+		maxAttempts: cfg.MaxAttempts,
+		secret:      []byte(cfg.Secret),
+		deliveries:  newWorkerPool(cfg.Concurrency, queueSize),
+		deadLetters: deadLetters,
+	}
+}
+
+// Record queues ev for delivery without blocking, dead-lettering it when
+// the webhook's queue is full.
+func (s *webhookSink) Record(ev usageEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		webhookLog.Errorf("Failed to encode usage event: %v", err)
+		return
+	}
+	if !s.deliveries.submit(func() { s.send(ev.RequestID, body) }) {
+		webhookLog.Warnf("Dead-lettering usage event %s, delivery queue is full", ev.RequestID)
+		s.deadLetters.Inc()
+	}
+}
+
+// send delivers body, retrying with backoff up to maxAttempts.
+func (s *webhookSink) send(requestID string, body []byte) {
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		retry, err := s.deliver(body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == s.maxAttempts {
+			webhookLog.Warnf("Dead-lettering usage event %s after %d attempts: %v", requestID, attempt, err)
+			s.deadLetters.Inc()
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// deliver POSTs body once. It reports whether a failure is worth retrying:
+// transport errors, 429s and 5xxs are, other statuses are not.
+func (s *webhookSink) deliver(body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(s.secret) > 0 {
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write(body)
+		req.Header.Set(headerWebhookSignature, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	// drain the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, fmt.Errorf("webhook responded %s", resp.Status)
+}
+
+// Close waits for queued deliveries, retries included, to finish.
+func (s *webhookSink) Close() error {
+	s.deliveries.stop()
+	s.client.CloseIdleConnections()
+	return nil
+}
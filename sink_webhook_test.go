@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWebhookSinkDelivers(t *testing.T) {
+	var received atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	deadLetters := prometheus.NewCounter(prometheus.CounterOpts{Name: "dead_letters"})
+	s := newWebhookSink(&webhookConfig{URL: srv.URL, Timeout: duration(time.Second), MaxAttempts: 1, Concurrency: 2}, 10, deadLetters)
+	for range 5 {
+		s.Record(usageEvent{RequestID: "req"})
+	}
+	s.Close()
+	if got := received.Load(); got != 5 {
+		t.Errorf("received %d events, want 5", got)
+	}
+	if got := testutil.ToFloat64(deadLetters); got != 0 {
+		t.Errorf("dead-lettered %v events, want 0", got)
+	}
+}
+
+func TestWebhookSinkDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	deadLetters := prometheus.NewCounter(prometheus.CounterOpts{Name: "dead_letters"})
+	s := newWebhookSink(&webhookConfig{URL: srv.URL, Timeout: duration(5 * time.Second), MaxAttempts: 1, Concurrency: 1}, 2, deadLetters)
+
+	// one delivery in flight and two queued fill the webhook; the rest are
+	// dead-lettered rather than blocking the caller
+	start := time.Now()
+	s.Record(usageEvent{RequestID: "in-flight"})
+	time.Sleep(50 * time.Millisecond)
+	for range 5 {
+		s.Record(usageEvent{RequestID: "queued"})
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Record blocked for %s", d)
+	}
+	if got := testutil.ToFloat64(deadLetters); got != 3 {
+		t.Errorf("dead-lettered %v events, want 3", got)
+	}
+	close(release)
+	s.Close()
+}
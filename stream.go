@@ -0,0 +1,228 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	configPb "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	filterPb "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_proc/v3"
+	extProcPb "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// streamState holds what we've learned about a single ext_proc stream (one
+// HTTP exchange) across its frames.
+type streamState struct {
+	path      string
+	requestID string
+	tenant    string
+	model     string
+	request   requestInfo
+	// processingID is the filter's own id for the request, when enabled.
+	processingID string
+	// requestEncoding is the request's content-encoding, if any.
+	requestEncoding string
+	// requestHash is the canonical request body hash, when enabled.
+	requestHash string
+	// maxCostUSD is the request's estimated maximum cost, formatted, when
+	// enabled and one could be made.
+	maxCostUSD string
+	// modelProvider is the provider the request's host maps to for model
+	// prefixing, if any.
+	modelProvider string
+	// reportedModel is model qualified with modelProvider, the name it is
+	// reported under in metrics, headers and usage events. Pricing, credits
+	// and other per-model config use the bare model.
+	reportedModel string
+	// forcedProvider is the provider the client named in its x-llm-provider
+	// request header, if any.
+	forcedProvider string
+	// receivedAt is when the RequestHeaders frame arrived.
+	receivedAt time.Time
+	// attempt is Envoy's x-envoy-attempt-count for the request, or 0 when the
+	// route doesn't send it.
+	attempt int
+
+	responseContentType string
+	responseStatus      string
+	responseBody        []byte
+	responseBodyMode    filterPb.ProcessingMode_BodySendMode
+	// responseLimit is the most bytes a response body the filter chose to
+	// buffer may grow to, from adaptive_buffering; zero is unlimited.
+	responseLimit int64
+	// responseOverflow names the limit the response body outgrew, after
+	// which it is neither accumulated nor parsed.
+	responseOverflow string
+	// responseBaggage is the upstream response's baggage header.
+	responseBaggage string
+	// upstreamServiceTime is Envoy's x-envoy-upstream-service-time, in ms.
+	upstreamServiceTime int64
+	// bufferedBytes is how much of the buffer budget the inspected request
+	// body holds. It is only returned when the stream ends.
+	bufferedBytes int
+	// responseBytes is how much of buffers the response body holds. It is
+	// returned when the body is dropped or replaced.
+	responseBytes int
+	buffers       *bufferBudget
+	// responseStart is when the first ResponseBody frame arrived.
+	responseStart time.Time
+	// usageRecorded is set once the response's usage has been recorded, so
+	// a stream abandoned afterwards doesn't record it again.
+	usageRecorded bool
+
+	// endpoint classifies the response (completions or embeddings) and
+	// provider is the registered parser that handled it.
+	endpoint string
+	provider string
+	// responseFormat is the parser path usage was parsed on: the parser's
+	// name, with ";fallback" when the content type wasn't recognised and
+	// ";estimated" when usage was estimated instead.
+	responseFormat string
+
+	// bodySkipped records that the response body was turned off in
+	// ResponseHeaders, e.g. because the request wasn't sampled.
+	bodySkipped bool
+
+	// overBudget is set once a frame of the stream has taken longer than
+	// the processing budget.
+	overBudget bool
+
+	// observed is set when Envoy runs the filter in observability mode, in
+	// which it ignores our responses, so none are built or sent.
+	observed bool
+
+	// responseHeadersSeen records that the ResponseHeaders frame (and its
+	// ModeOverride) has been handled.
+	responseHeadersSeen bool
+
+	trace traceContext
+	// parentTrace is the caller's trace and span from its traceparent, for
+	// metric exemplars. Empty without trace_exemplars or a valid traceparent.
+	parentTrace traceContext
+
+	// labelHeaders are the request's values for the configured metric label
+	// headers, in config order.
+	labelHeaders []string
+
+	// sampled is false when sampling excluded this request from usage
+	// parsing; sampleWeight extrapolates metrics for those that were sampled.
+	sampled      bool
+	sampleWeight float64
+
+	// warnings name the optional processing steps that failed for this
+	// stream, for the x-llm-processing-warning header.
+	warnings []string
+
+	// release frees the model concurrency slot held by this stream, if any.
+	release func()
+}
+
+func newStreamState() *streamState {
+	return &streamState{sampled: true, sampleWeight: 1}
+}
+
+// resetResponse discards everything captured about the response so far, as
+// when a retried response replaces the first.
+func (st *streamState) resetResponse(status, contentType string) {
+	st.responseStatus = status
+	st.responseContentType = contentType
+	st.dropResponseBody()
+	st.endpoint = ""
+	st.provider = ""
+	st.responseFormat = ""
+	st.responseOverflow = ""
+	st.usageRecorded = false
+}
+
+// dropResponseBody discards the buffered response body, returning its bytes
+// to the buffer budget.
+func (st *streamState) dropResponseBody() {
+	st.responseBody = nil
+	if st.buffers != nil {
+		st.buffers.release(st.responseBytes)
+	}
+	st.responseBytes = 0
+}
+
+// providerName returns the provider to report in x-llm-provider: the one the
+// client forced, else the one the request host maps to, else the one the
+// response body looks like.
+func (st *streamState) providerName() string {
+	switch {
+	case st.forcedProvider != "":
+		return st.forcedProvider
+	case st.modelProvider != "":
+		return st.modelProvider
+	}
+	return detectProvider(st.responseBody)
+}
+
+// exemplar returns the exemplar labels for the stream's metric
+// observations: its processing id and its caller's trace and span, those
+// it has, or nil when it has none.
+func (st *streamState) exemplar() prometheus.Labels {
+	labels := prometheus.Labels{}
+	if st.processingID != "" {
+		labels["processing_id"] = st.processingID
+	}
+	if st.parentTrace.traceID != "" {
+		labels["trace_id"] = st.parentTrace.traceID
+		labels["span_id"] = st.parentTrace.spanID
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// retry reports whether this stream is an Envoy retry of an earlier attempt.
+func (st *streamState) retry() bool {
+	return st.attempt > 1
+}
+
+// mayBeRetried reports whether Envoy could still replace this response with
+// another attempt: the route has retries (it sends an attempt count) and the
+// response was not a success.
+func (st *streamState) mayBeRetried() bool {
+	return st.attempt > 0 && !strings.HasPrefix(st.responseStatus, "2")
+}
+
+// headerValue returns the value of the named header, or "" if absent. Envoy
+// may send values in either Value or RawValue.
+func headerValue(headers *configPb.HeaderMap, name string) string {
+	for _, h := range headers.GetHeaders() {
+		if strings.EqualFold(h.GetKey(), name) {
+			if h.GetValue() != "" {
+				return h.GetValue()
+			}
+			return string(h.GetRawValue())
+		}
+	}
+	return ""
+}
+
+type recvResult struct {
+	req *extProcPb.ProcessingRequest
+	err error
+}
+
+// recvLoop receives from srv on its own goroutine so the processing loop can
+// wait on timers as well as frames. It stops after the first error or when
+// the stream ends.
+func recvLoop(srv extProcPb.ExternalProcessor_ProcessServer) <-chan recvResult {
+	ch := make(chan recvResult)
+	go func() {
+		for {
+			req, err := srv.Recv()
+			select {
+			case ch <- recvResult{req, err}:
+			case <-srv.Context().Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return ch
+}
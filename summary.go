@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// summaryWriter writes one logfmt line per recorded request, apart from the
+// leveled logs, so there is an audit trail whatever the log levels are.
+type summaryWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newSummaryWriter(w io.Writer) *summaryWriter {
+	return &summaryWriter{w: w}
+}
+
+// write writes ev's summary line. Each line is a single Write, serialised so
+// concurrent streams can't interleave.
+func (s *summaryWriter) write(ev usageEvent, status string, elapsed time.Duration) {
+	line := fmt.Sprintf("request_summary request_id=%s%s model=%s provider=%s status=%s prompt_tokens=%d completion_tokens=%d total_tokens=%d cost_usd=%s duration_ms=%d\n",
+		logfmtValue(ev.RequestID), processingIDField(ev.ProcessingID), logfmtValue(ev.Model), logfmtValue(ev.Provider), logfmtValue(status),
+		ev.PromptTokens, ev.CompletionTokens, ev.TotalTokens,
+		strconv.FormatFloat(ev.CostUSD, 'f', -1, 64), elapsed.Milliseconds())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := io.WriteString(s.w, line); err != nil {
+		mainLog.Errorf("Failed to write request summary: %v", err)
+	}
+}
+
+// logfmtValue quotes v if it is empty or would otherwise break the line
+// into the wrong fields.
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\\\n\t") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// processingIDField is the summary's processing_id field, or nothing when
+// processing ids are off.
+func processingIDField(id string) string {
+	if id == "" {
+		return ""
+	}
+	return " processing_id=" + id
+}
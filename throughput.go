@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultThroughputAlpha weights each new streamed response's rate in the
+// moving average when avg_tokens_per_second.alpha is unset.
+const defaultThroughputAlpha = 0.1
+
+// throughputConfig enables a per-model moving average of streaming
+// throughput.
+type throughputConfig struct {
+	// Alpha is the smoothing factor in (0, 1]: the weight of each new
+	// response's rate against the average so far. Defaults to 0.1.
+	Alpha float64 `json:"alpha,omitempty"`
+}
+
+// throughputAverages is an exponentially weighted moving average of
+// completion tokens per second for each model, over streamed responses.
+type throughputAverages struct {
+	alpha float64
+
+	mu   sync.Mutex
+	avgs map[string]float64
+}
+
+// newThroughputAverages returns the averages for cfg, or nil when they are
+// off.
+func newThroughputAverages(cfg *throughputConfig) *throughputAverages {
+	if cfg == nil {
+		return nil
+	}
+	return &throughputAverages{alpha: cfg.Alpha, avgs: make(map[string]float64)}
+}
+
+// observe folds a response that streamed completionTokens over elapsed into
+// model's average. The first response seeds it.
+func (t *throughputAverages) observe(model string, completionTokens int64, elapsed time.Duration) {
+	if completionTokens <= 0 || elapsed <= 0 {
+		return
+	}
+	rate := float64(completionTokens) / elapsed.Seconds()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if avg, ok := t.avgs[model]; ok {
+		rate = t.alpha*rate + (1-t.alpha)*avg
+	}
+	t.avgs[model] = rate
+}
+
+// average returns model's average tokens per second, if any response to it
+// has been observed.
+func (t *throughputAverages) average(model string) (float64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	avg, ok := t.avgs[model]
+	return avg, ok
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dlclark/regexp2"
+)
+
+// Tokenizer counts the tokens text encodes to for a model. It backs every
+// token estimate the filter makes: request pre-estimates, and so the max
+// cost quote, and the usage of streams that report none.
+type Tokenizer interface {
+	CountTokens(model, text string) int
+}
+
+// defaultCharsPerToken is the rough ratio of English text to tokens the
+// heuristic tokenizer uses unless configured otherwise.
+const defaultCharsPerToken = 4
+
+// cl100kPattern is the pre-tokenization pattern of the cl100k_base encoding.
+// It needs lookahead, which the regexp package lacks.
+const cl100kPattern = `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+`
+
+// heuristicTokenizer counts charsPerToken characters as a token, whatever the
+// model.
+type heuristicTokenizer struct {
+	charsPerToken float64
+}
+
+func (t heuristicTokenizer) CountTokens(_, text string) int {
+	return int(math.Ceil(float64(utf8.RuneCountInString(text)) / t.charsPerToken))
+}
+
+// wordsTokenizer counts each whitespace-separated word as tokensPerWord
+// tokens, whatever the model.
+type wordsTokenizer struct {
+	tokensPerWord float64
+}
+
+func (t wordsTokenizer) CountTokens(_, text string) int {
+	return int(math.Ceil(float64(len(strings.Fields(text))) * t.tokensPerWord))
+}
+
+// defaultEstimatorRatios are the ratios stream_usage_estimate's own
+// estimators default to: characters per token for chars and tokens per word
+// for words.
+var defaultEstimatorRatios = map[string]float64{
+	"chars": defaultCharsPerToken,
+	"words": 1.33,
+}
+
+// maxPieceBytes caps the pre-tokenized pieces byte pair merged exactly, since
+// merging is quadratic in the piece's length. Longer pieces, such as long
+// runs of whitespace or punctuation, are counted with the heuristic.
+const maxPieceBytes = 256
+
+// tiktokenTokenizer counts tokens exactly with a tiktoken BPE encoding, for
+// the models it covers, and with the heuristic for the rest.
+type tiktokenTokenizer struct {
+	ranks    map[string]int
+	pattern  *regexp2.Regexp
+	models   []string
+	fallback Tokenizer
+}
+
+// loadTiktokenRanks reads a tiktoken encoding file, such as
+// cl100k_base.tiktoken: one base64 token and its rank per line.
+func loadTiktokenRanks(path string) (map[string]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ranks := make(map[string]int)
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		if sc.Text() == "" {
+			continue
+		}
+		token, rank, ok := strings.Cut(sc.Text(), " ")
+		b, err := base64.StdEncoding.DecodeString(token)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid token", path, line)
+		}
+		r, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid rank %q", path, line, rank)
+		}
+		ranks[string(b)] = r
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranks) == 0 {
+		return nil, fmt.Errorf("%s: no tokens", path)
+	}
+	return ranks, nil
+}
+
+func (t *tiktokenTokenizer) CountTokens(model, text string) int {
+	if len(t.models) > 0 && !slices.ContainsFunc(t.models, func(prefix string) bool {
+		return strings.HasPrefix(model, prefix)
+	}) {
+		return t.fallback.CountTokens(model, text)
+	}
+	n := 0
+	m, err := t.pattern.FindStringMatch(text)
+	for ; m != nil && err == nil; m, err = t.pattern.FindNextMatch(m) {
+		if piece := m.String(); len(piece) > maxPieceBytes {
+			n += t.fallback.CountTokens(model, piece)
+		} else {
+			n += t.pieceTokens(piece)
+		}
+	}
+	return n
+}
+
+// pieceTokens counts the tokens of a pre-tokenized piece by byte pair
+// merging: adjacent parts are merged lowest rank first until no pair is a
+// token.
+func (t *tiktokenTokenizer) pieceTokens(piece string) int {
+	if _, ok := t.ranks[piece]; ok {
+		return 1
+	}
+	// bounds[i] is where the i-th part starts
+	bounds := make([]int, len(piece)+1)
+	for i := range bounds {
+		bounds[i] = i
+	}
+	for len(bounds) > 2 {
+		best, at := math.MaxInt, -1
+		for i := 0; i+2 < len(bounds); i++ {
+			if r, ok := t.ranks[piece[bounds[i]:bounds[i+2]]]; ok && r < best {
+				best, at = r, i
+			}
+		}
+		if at < 0 {
+			break
+		}
+		bounds = slices.Delete(bounds, at+1, at+2)
+	}
+	return len(bounds) - 1
+}
+
+// tokenizerConfig selects the tokenizer token estimates are made with.
+type tokenizerConfig struct {
+	// Type is heuristic (the default) or tiktoken.
+	Type string `json:"type,omitempty"`
+	// CharsPerToken is the heuristic's ratio, 4 by default. The tiktoken
+	// tokenizer uses the heuristic for models it doesn't cover.
+	CharsPerToken float64 `json:"chars_per_token,omitempty"`
+	// EncodingFile is a tiktoken encoding file, e.g. cl100k_base.tiktoken.
+	// Required for tiktoken.
+	EncodingFile string `json:"encoding_file,omitempty"`
+	// Pattern is the encoding's pre-tokenization regex, cl100k_base's by
+	// default.
+	Pattern string `json:"pattern,omitempty"`
+	// Models are the model name prefixes the encoding covers. It covers
+	// every model when empty.
+	Models []string `json:"models,omitempty"`
+
+	tokenizer Tokenizer
+}
+
+// load validates the config, applying defaults, and builds its tokenizer.
+func (c *tokenizerConfig) load() error {
+	if c.CharsPerToken == 0 {
+		c.CharsPerToken = defaultCharsPerToken
+	}
+	if c.CharsPerToken < 0 {
+		return fmt.Errorf("chars_per_token must be positive")
+	}
+	heuristic := heuristicTokenizer{charsPerToken: c.CharsPerToken}
+	switch c.Type {
+	case "", "heuristic":
+		c.tokenizer = heuristic
+	case "tiktoken":
+		if c.EncodingFile == "" {
+			return fmt.Errorf("encoding_file is required for tiktoken")
+		}
+		if c.Pattern == "" {
+			c.Pattern = cl100kPattern
+		}
+		pattern, err := regexp2.Compile(c.Pattern, regexp2.None)
+		if err != nil {
+			return fmt.Errorf("pattern: %w", err)
+		}
+		ranks, err := loadTiktokenRanks(c.EncodingFile)
+		if err != nil {
+			return err
+		}
+		c.tokenizer = &tiktokenTokenizer{ranks: ranks, pattern: pattern, models: c.Models, fallback: heuristic}
+	default:
+		return fmt.Errorf("type must be heuristic or tiktoken, got %q", c.Type)
+	}
+	return nil
+}
+
+// get returns the loaded tokenizer, or the default heuristic one when none
+// is configured.
+func (c *tokenizerConfig) get() Tokenizer {
+	if c == nil || c.tokenizer == nil {
+		return heuristicTokenizer{charsPerToken: defaultCharsPerToken}
+	}
+	return c.tokenizer
+}
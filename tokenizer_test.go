@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tinyTokenizer loads testdata/tiny.tiktoken, an encoding of every single
+// byte plus merges up to "hello" and " world".
+func tinyTokenizer(t *testing.T, models ...string) Tokenizer {
+	t.Helper()
+	c := &tokenizerConfig{Type: "tiktoken", EncodingFile: filepath.Join("testdata", "tiny.tiktoken"), Models: models}
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	return c.get()
+}
+
+func TestHeuristicVsExactTokens(t *testing.T) {
+	exact := tinyTokenizer(t)
+	heuristic := heuristicTokenizer{charsPerToken: defaultCharsPerToken}
+	tests := []struct {
+		text          string
+		wantHeuristic int
+		wantExact     int
+	}{
+		{text: "", wantHeuristic: 0, wantExact: 0},
+		{text: "hello", wantHeuristic: 2, wantExact: 1},
+		{text: "hello world", wantHeuristic: 3, wantExact: 2},
+		// " there" only merges "he": " ", "t", "he", "r", "e"
+		{text: "hello there", wantHeuristic: 3, wantExact: 6},
+		{text: "hello 123", wantHeuristic: 3, wantExact: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := heuristic.CountTokens("gpt-4", tt.text); got != tt.wantHeuristic {
+				t.Errorf("heuristic = %d, want %d", got, tt.wantHeuristic)
+			}
+			if got := exact.CountTokens("gpt-4", tt.text); got != tt.wantExact {
+				t.Errorf("exact = %d, want %d", got, tt.wantExact)
+			}
+		})
+	}
+}
+
+func TestTiktokenModels(t *testing.T) {
+	tok := tinyTokenizer(t, "gpt-4")
+	if got := tok.CountTokens("gpt-4o", "hello world"); got != 2 {
+		t.Errorf("covered model = %d tokens, want 2", got)
+	}
+	if got := tok.CountTokens("claude-3-5-sonnet", "hello world"); got != 3 {
+		t.Errorf("other model = %d tokens, want the heuristic's 3", got)
+	}
+}
+
+func TestTiktokenLongPieceFallsBack(t *testing.T) {
+	tok := tinyTokenizer(t)
+	// a run of spaces is one piece; merged exactly it would be a token per
+	// byte, over the cap it is counted with the heuristic instead
+	short := strings.Repeat(" ", maxPieceBytes)
+	if got := tok.CountTokens("gpt-4", short); got != maxPieceBytes {
+		t.Errorf("%d byte piece = %d tokens, want %d", len(short), got, maxPieceBytes)
+	}
+	long := strings.Repeat(" ", 4*maxPieceBytes)
+	if got := tok.CountTokens("gpt-4", long); got != maxPieceBytes {
+		t.Errorf("%d byte piece = %d tokens, want the heuristic's %d", len(long), got, maxPieceBytes)
+	}
+}
+
+func TestWordsTokenizer(t *testing.T) {
+	if got := (wordsTokenizer{tokensPerWord: 1.33}).CountTokens("", "the quick  brown\nfox"); got != 6 {
+		t.Errorf("got %d, want 6", got)
+	}
+}
+
+// countingTokenizer counts how often it is asked to count.
+type countingTokenizer struct{ calls int }
+
+func (c *countingTokenizer) CountTokens(_, text string) int {
+	c.calls++
+	return len(text)
+}
+
+func TestParseRequestTokenizesOnlyWhenAsked(t *testing.T) {
+	body := []byte(`{"model":"gpt-4o","max_tokens":10,"messages":[{"role":"user","content":"hello"}]}`)
+	if info := parseRequest(body, nil, nil); info.EstimatedTokens != 0 || info.MaxTokens != 10 {
+		t.Errorf("without a tokenizer got %+v, want max_tokens only", info)
+	}
+	tok := &countingTokenizer{}
+	if info := parseRequest(body, nil, tok); info.EstimatedPromptTokens != 5 || info.EstimatedTokens != 15 || tok.calls != 1 {
+		t.Errorf("with a tokenizer got %+v after %d calls", info, tok.calls)
+	}
+}
+
+func TestRequestTokenizerOnlyWhenNeeded(t *testing.T) {
+	for config, want := range map[string]bool{
+		"":                            false,
+		"request_hash: true":          false,
+		"estimate_delta: true":        true,
+		"estimate_max_cost: true":     true,
+		"stream_usage_estimate: true": true,
+	} {
+		s := newTestServer(t, testConfig(t, config))
+		if got := s.requestTokenizer != nil; got != want {
+			t.Errorf("%q: request tokenizer = %v, want %v", config, got, want)
+		}
+	}
+}
+
+func TestStreamUsageEstimateConfig(t *testing.T) {
+	tests := []struct {
+		config string
+		want   Tokenizer
+	}{
+		{config: "stream_usage_estimate: false", want: nil},
+		{config: "stream_usage_estimate: true", want: heuristicTokenizer{charsPerToken: 4}},
+		{config: "stream_usage_estimate: true\ntokenizer: {chars_per_token: 3}", want: heuristicTokenizer{charsPerToken: 3}},
+		{config: "stream_usage_estimate: {}", want: heuristicTokenizer{charsPerToken: 4}},
+		{config: "stream_usage_estimate: {estimator: chars}", want: heuristicTokenizer{charsPerToken: 4}},
+		{config: "stream_usage_estimate: {estimator: chars, ratio: 3.5}", want: heuristicTokenizer{charsPerToken: 3.5}},
+		{config: "stream_usage_estimate: {estimator: words}", want: wordsTokenizer{tokensPerWord: 1.33}},
+		{config: "stream_usage_estimate: {estimator: words, ratio: 1.5}", want: wordsTokenizer{tokensPerWord: 1.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.config, func(t *testing.T) {
+			s := newTestServer(t, testConfig(t, tt.config))
+			if s.streamTokenizer != tt.want {
+				t.Errorf("got %#v, want %#v", s.streamTokenizer, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamUsageEstimateConfigErrors(t *testing.T) {
+	for _, config := range []string{
+		"stream_usage_estimate: {estimator: bytes}",
+		"stream_usage_estimate: {estimator: words, ratio: -1}",
+		"stream_usage_estimate: {ratio: 2}",
+		"stream_usage_estimate: sometimes",
+	} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(path); err == nil {
+			t.Errorf("%q: want an error", config)
+		}
+	}
+}
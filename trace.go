@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+// traceContext identifies this filter's span for a stream, following W3C
+// trace context.
+type traceContext struct {
+	traceID string
+	spanID  string
+}
+
+// newTraceContext continues the trace from an incoming traceparent header
+// with a new span, or starts a new trace when there is no valid parent.
+func newTraceContext(traceparent string) traceContext {
+	tc := traceContext{traceID: parseTraceparent(traceparent).traceID, spanID: randomHex(8)}
+	if tc.traceID == "" {
+		tc.traceID = randomHex(16)
+	}
+	return tc
+}
+
+// parseTraceparent returns the trace and parent span a traceparent header
+// identifies, or the zero traceContext when it isn't valid.
+func parseTraceparent(traceparent string) traceContext {
+	// version-traceid-parentid-flags, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 || !isHexID(parts[1], 32) || !isHexID(parts[2], 16) {
+		return traceContext{}
+	}
+	return traceContext{traceID: parts[1], spanID: parts[2]}
+}
+
+// isHexID reports whether s is a valid trace or span id: n hex characters,
+// not all zero.
+func isHexID(s string, n int) bool {
+	if len(s) != n || s == strings.Repeat("0", n) {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestParseTraceparent(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	tests := []struct {
+		name        string
+		traceparent string
+		want        traceContext
+	}{
+		{name: "valid", traceparent: "00-" + traceID + "-00f067aa0ba902b7-01", want: traceContext{traceID: traceID, spanID: "00f067aa0ba902b7"}},
+		{name: "zero trace id", traceparent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "zero span id", traceparent: "00-" + traceID + "-0000000000000000-01"},
+		{name: "non-hex span id", traceparent: "00-" + traceID + "-00f067aa0ba902zz-01"},
+		{name: "short span id", traceparent: "00-" + traceID + "-00f067aa0ba902-01"},
+		{name: "missing flags", traceparent: "00-" + traceID + "-00f067aa0ba902b7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseTraceparent(tt.traceparent); got != tt.want {
+				t.Errorf("parseTraceparent(%q) = %+v, want %+v", tt.traceparent, got, tt.want)
+			}
+		})
+	}
+}
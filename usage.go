@@ -0,0 +1,39 @@
+package main
+
+import (
+	"time"
+)
+
+// usageEvent is the token accounting for a single completed request, as
+// recorded to sinks.
+type usageEvent struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Environment string    `json:"environment,omitempty"`
+	Model       string    `json:"model,omitempty"`
+	Provider    string    `json:"provider,omitempty"`
+	Tenant      string    `json:"tenant,omitempty"`
+	RequestID   string    `json:"request_id,omitempty"`
+	// ProcessingID is the filter's own id for the request, when enabled.
+	ProcessingID string `json:"processing_id,omitempty"`
+	tokenUsage
+	CostUSD float64 `json:"cost_usd"`
+	// CostEstimated is set when the model had no pricing and was costed at
+	// the default rate.
+	CostEstimated bool `json:"cost_estimated,omitempty"`
+	// Credits is the usage in billing credits, for models with a credit
+	// rate.
+	Credits float64 `json:"credits,omitempty"`
+	// RequestTotalCostUSD is the cost of every attempt at the request so
+	// far, this one included, when retry_cost_window is set.
+	RequestTotalCostUSD float64 `json:"request_total_cost_usd,omitempty"`
+	// UpstreamServiceTimeMS is the upstream latency Envoy reported, from
+	// the request to the upstream's response headers.
+	UpstreamServiceTimeMS int64 `json:"upstream_service_time_ms,omitempty"`
+
+	// priced is false when the model had no pricing and CostUSD is meaningless.
+	priced bool
+	// credited is set when the model has a credit rate.
+	credited bool
+	// costTiers is CostUSD split by pricing tier, for tiered models.
+	costTiers []float64
+}